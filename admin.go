@@ -0,0 +1,164 @@
+package toystore
+
+import (
+	"context"
+	"sort"
+
+	"github.com/rlayte/toystore/data"
+)
+
+// Streamer defines the method used to fetch a node's ranges from the other
+// nodes when it bootstraps, one page at a time.
+type Streamer interface {
+	Ranges(ctx context.Context, address string, peer string, weight int, start string, limit int) ([]*data.Data, string, error)
+}
+
+// Decommission permanently removes the node from the cluster.
+// Every key it stores is streamed to the nodes that take over its ranges
+// before the other nodes remove it from their rings, then the node is
+// stopped. Writes, streams and anti-entropy merges to the node fail with
+// ErrDecommissioning from the start, so none are lost after its keys have
+// been streamed. If any key can't be streamed the node keeps its ranges,
+// accepts writes again and returns a TransferError, and Decommission can
+// be retried.
+func (t *Toystore) Decommission() error {
+	if err := t.decommission(); err != nil {
+		return err
+	}
+
+	return t.Stop()
+}
+
+// decommission streams the node's ranges to their new owners and
+// broadcasts that it has left the ring, without stopping the node.
+func (t *Toystore) decommission() error {
+	t.log.Printf("Decommissioning")
+	t.decommissioning.Store(true)
+
+	if err := t.Departures.Remove(t.rpcAddress()); err != nil {
+		t.Ring.SetWeight(t.rpcAddress(), t.weight())
+		t.decommissioning.Store(false)
+		return err
+	}
+
+	t.lock.Lock()
+	t.decommissioned = true
+	t.lock.Unlock()
+
+	if t.Members != nil {
+		return t.Members.Update()
+	}
+
+	return nil
+}
+
+// isDecommissioned returns true once the node has streamed its ranges to
+// other nodes and left the ring.
+func (t *Toystore) isDecommissioned() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.decommissioned
+}
+
+// Bootstrap streams every key the node is a replica for from the other
+// members of the cluster. Until it finishes the node refuses reads with
+// ErrBootstrapping, so it doesn't return missing or stale data, but still
+// accepts writes so none are lost.
+// Keys are fetched from every member in case some replicas are stale, in
+// pages of the transfer chunk size. If a member can't be reached its error
+// is returned once the rest have been streamed; anti-entropy fills in any
+// keys that were missed.
+func (t *Toystore) Bootstrap() error {
+	t.bootstrapping.Store(true)
+	defer t.bootstrapping.Store(false)
+
+	t.log.Printf("Bootstrapping")
+	var err error
+
+	for _, address := range t.Ring.Members() {
+		if address == t.rpcAddress() {
+			continue
+		}
+
+		if streamErr := t.bootstrap(address); streamErr != nil {
+			t.log.Printf("Bootstrapping from %s failed: %s", address, streamErr)
+
+			if err == nil {
+				err = streamErr
+			}
+		}
+	}
+
+	return err
+}
+
+// bootstrap fetches every page of the node's ranges from the member at
+// address.
+func (t *Toystore) bootstrap(address string) error {
+	start := ""
+	count := 0
+
+	for {
+		items, next, err := t.streamer.Ranges(context.Background(), address, t.rpcAddress(), t.weight(), start, t.Streams.ChunkSize)
+
+		if err != nil {
+			return err
+		}
+
+		for _, item := range items {
+			t.Merge(item)
+		}
+
+		count += len(items)
+
+		if next == "" {
+			t.log.Printf("Bootstrapped %d items from %s", count, address)
+			return nil
+		}
+
+		start = next
+	}
+}
+
+// Ranges returns up to limit local keys after start, in key order, that
+// peer is a replica for, and the key to start the next page from. The next
+// key is empty once there are no more pages. A limit of 0 returns every
+// key.
+// Peer's preference lists are found on a copy of the ring with peer alive
+// and given the weight, in case the node hasn't seen it join yet. The
+// node's own ring isn't changed.
+func (t *Toystore) Ranges(peer string, weight int, start string, limit int) ([]*data.Data, string) {
+	r := t.Ring.Copy()
+	r.SetWeight(peer, weight)
+	r.Revive(peer)
+
+	keys := t.Data.Keys()
+	sort.Strings(keys)
+	first := sort.SearchStrings(keys, start)
+	items := []*data.Data{}
+
+	for i := first; i < len(keys); i++ {
+		key := keys[i]
+
+		if start != "" && key == start {
+			continue
+		}
+
+		nodes, _ := r.FindN(key, t.ReplicationLevel)
+
+		if !nodes.Contains(peer) {
+			continue
+		}
+
+		if value, ok := t.Data.Get(key); ok {
+			items = append(items, value)
+		}
+
+		if len(items) == limit {
+			return items, key
+		}
+	}
+
+	return items, ""
+}
@@ -0,0 +1,208 @@
+package toystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rlayte/toystore/data"
+	"github.com/rlayte/toystore/ring"
+)
+
+// FakeStreamer implements Streamer by calling other nodes' Ranges
+// directly.
+type FakeStreamer struct {
+	peers map[string]*Toystore
+}
+
+func (f *FakeStreamer) Ranges(ctx context.Context, address string, peer string, weight int, start string, limit int) ([]*data.Data, string, error) {
+	node, ok := f.peers[address]
+
+	if !ok {
+		return nil, "", &UnreachableError{address, errors.New("down")}
+	}
+
+	items, next := node.Ranges(peer, weight, start, limit)
+
+	return items, next, nil
+}
+
+func TestDecommissionStreamsRanges(t *testing.T) {
+	node, _ := newLocalCluster(3)
+	node.ReplicationLevel = 2
+	transferrer := &FakeTransferrer{sent: map[string][]*data.Data{}, status: true}
+	node.transferrer = transferrer
+	node.Streams = NewStreams(Config{}, node, transferrer)
+	node.Hints = NewHintedHandoff(Config{}, node.Metrics, transferrer)
+	node.Departures = NewDepartures(Config{RemovalTimeout: time.Hour}, node)
+
+	before := map[string]ring.PreferenceList{}
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprint(i)
+		node.Merge(data.New(key, "value"))
+		before[key], _ = node.Ring.FindN(key, node.ReplicationLevel)
+	}
+
+	if err := node.decommission(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !node.isDecommissioned() {
+		t.Error("Node should be decommissioned")
+	}
+
+	for key, previous := range before {
+		nodes, _ := node.Ring.FindN(key, node.ReplicationLevel)
+
+		for _, replica := range nodes {
+			found := false
+
+			for _, value := range transferrer.sent[replica.Address] {
+				found = found || value.Key == key
+			}
+
+			if replica.Address == node.rpcAddress() {
+				t.Errorf("Node should not replicate %s after decommissioning", key)
+			} else if previous.Contains(node.rpcAddress()) && !previous.Contains(replica.Address) && !found {
+				t.Errorf("%s should have been streamed to %s", key, replica.Address)
+			}
+		}
+	}
+}
+
+func TestBootstrapStreamsRanges(t *testing.T) {
+	streamer := &FakeStreamer{map[string]*Toystore{}}
+	a, b := newLocalNode(), newLocalNode()
+	b.Host = "127.0.0.2"
+	b.Ring = ring.NewHashRing()
+	b.Ring.Add(b.rpcAddress())
+
+	for _, node := range []*Toystore{a, b} {
+		node.ReplicationLevel = 2
+		node.streamer = streamer
+		node.Streams = NewStreams(Config{}, node, nil)
+		node.Streams.ChunkSize = 3
+		streamer.peers[node.rpcAddress()] = node
+	}
+
+	a.Ring.Add(b.rpcAddress())
+
+	for i := 0; i < 10; i++ {
+		a.Merge(data.New(fmt.Sprint(i), "value"))
+	}
+
+	b.bootstrapping.Store(true)
+
+	if _, err := b.CoordinateGet(context.Background(), "1"); !errors.Is(err, ErrQuorumNotMet) {
+		t.Errorf("Reads should fail while bootstrapping, got %v", err)
+	}
+
+	b.Ring.Add(a.rpcAddress())
+
+	if err := b.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(b.Data.Keys()) != 10 {
+		t.Errorf("b should have every key, but has %d", len(b.Data.Keys()))
+	}
+
+	if b.bootstrapping.Load() {
+		t.Error("b should serve reads after bootstrapping")
+	}
+}
+
+func TestRangesPages(t *testing.T) {
+	node := newLocalNode()
+	node.ReplicationLevel = 2
+	peer := "127.0.0.2:3001"
+
+	for i := 0; i < 10; i++ {
+		node.Merge(data.New(fmt.Sprint(i), "value"))
+	}
+
+	seen := map[string]bool{}
+	start := ""
+	pages := 0
+
+	for {
+		items, next := node.Ranges(peer, 1, start, 3)
+		pages++
+
+		if len(items) > 3 {
+			t.Fatalf("Pages should have at most 3 items, got %d", len(items))
+		}
+
+		for _, item := range items {
+			if seen[item.Key] {
+				t.Errorf("%s was returned twice", item.Key)
+			}
+
+			seen[item.Key] = true
+		}
+
+		if next == "" {
+			break
+		}
+
+		start = next
+	}
+
+	if len(seen) != 10 || pages != 4 {
+		t.Errorf("Every key should be returned in 4 pages, got %d keys in %d", len(seen), pages)
+	}
+
+	if members := node.Ring.Members(); len(members) != 1 {
+		t.Errorf("Ranges should not add the peer to the node's ring, but members are %v", members)
+	}
+}
+
+func TestDecommissionRejectsWrites(t *testing.T) {
+	node, _ := newLocalCluster(3)
+	transferrer := &FakeTransferrer{sent: map[string][]*data.Data{}, status: true}
+	node.transferrer = transferrer
+	node.Streams = NewStreams(Config{}, node, transferrer)
+	node.Hints = NewHintedHandoff(Config{}, node.Metrics, transferrer)
+	node.Departures = NewDepartures(Config{RemovalTimeout: time.Hour}, node)
+	node.AntiEntropy = NewAntiEntropy(Config{}, node, nil)
+	handler := &RpcHandler{store: node}
+
+	if err := node.decommission(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := handler.Put(&PutArgs{Value: data.New("foo", "bar")}, &PutReply{}); err != ErrDecommissioning {
+		t.Errorf("Replica puts should fail with ErrDecommissioning, got %v", err)
+	}
+
+	if err := handler.HintPut(&HintArgs{Data: data.New("foo", "bar"), Hint: "b:3001"}, &HintReply{}); err != ErrDecommissioning {
+		t.Errorf("Hints should fail with ErrDecommissioning, got %v", err)
+	}
+
+	result := node.writeReplica(context.Background(), node.rpcAddress(), "", data.New("foo", "bar"))
+
+	if result.err != ErrDecommissioning {
+		t.Errorf("Local writes should fail with ErrDecommissioning, got %v", result.err)
+	}
+
+	items := []*data.Data{data.New("foo", "bar")}
+
+	if err := handler.Transfer(&TransferArgs{Data: items}, &TransferReply{}); err != ErrDecommissioning {
+		t.Errorf("Transfers should fail with ErrDecommissioning, got %v", err)
+	}
+
+	if err := handler.MerkleSync(&MerkleSyncArgs{Data: items}, &MerkleSyncReply{}); err != ErrDecommissioning {
+		t.Errorf("Anti-entropy syncs should fail with ErrDecommissioning, got %v", err)
+	}
+
+	if _, err := node.AntiEntropy.Merge(items); err != ErrDecommissioning {
+		t.Errorf("Anti-entropy merges should fail with ErrDecommissioning, got %v", err)
+	}
+
+	if _, ok := node.Data.Get("foo"); ok {
+		t.Error("Writes after decommissioning should not be stored")
+	}
+}
@@ -0,0 +1,372 @@
+package toystore
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rlayte/toystore/data"
+	"github.com/rlayte/toystore/merkle"
+	"github.com/rlayte/toystore/ring"
+)
+
+const (
+	// DefaultAntiEntropyInterval is used if Config.AntiEntropyInterval isn't
+	// set.
+	DefaultAntiEntropyInterval = time.Minute
+
+	// Depth of the Merkle tree kept for each range of the ring. Each tree
+	// has 2^merkleDepth leaves.
+	merkleDepth = 6
+)
+
+// TreeExchanger defines the methods used to compare and synchronize the
+// data two replicas share.
+type TreeExchanger interface {
+	MerkleTrees(ctx context.Context, address string, peer string) (map[string]*merkle.Tree, error)
+	MerkleSync(ctx context.Context, address string, peer string, leaves map[string][]int, items []*data.Data) ([]*data.Data, error)
+}
+
+// rangeTree is the Merkle tree of the keys in one range of the ring.
+type rangeTree struct {
+	tree *merkle.Tree
+
+	// Digests of the values in the tree, so they can be removed when the
+	// value changes.
+	keys map[string][]byte
+
+	// Set when the leaves have changed since the tree was last built.
+	dirty bool
+}
+
+// AntiEntropy periodically compares the keys the node shares with each
+// other member of the cluster using Merkle trees. Only the leaves that
+// differ are exchanged and merged on both nodes, so replicas that missed
+// writes or hints eventually converge.
+//
+// A tree is kept for each range of the ring, named by the token that ends
+// it. Trees are built from the Store on the first exchange, or after the
+// ring's tokens change, and are then kept up to date by Update as values
+// are merged or deleted. Two nodes only compare the ranges whose
+// preference lists contain both of them.
+type AntiEntropy struct {
+	ScanInterval time.Duration
+
+	store  *Toystore
+	client TreeExchanger
+
+	lock  *sync.Mutex
+	trees map[string]*rangeTree
+
+	// The range each key was added to.
+	ranges map[string]string
+
+	// Set when a key was updated in a range without a tree, so the trees
+	// are rebuilt on the next exchange.
+	stale bool
+
+	stop chan bool
+	done chan bool
+}
+
+// scan periodically exchanges trees with every live member of the ring.
+// It returns once Stop is called.
+func (a *AntiEntropy) scan() {
+	defer close(a.done)
+
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-time.After(a.ScanInterval):
+		}
+
+		for _, address := range a.store.Ring.Members() {
+			if address == a.store.rpcAddress() {
+				continue
+			}
+
+			if err := a.Exchange(address); err != nil {
+				a.store.log.Printf("Anti-entropy with %s failed: %s", address, err)
+			}
+		}
+	}
+}
+
+// Start runs the scan process in the background until Stop is called.
+func (a *AntiEntropy) Start() {
+	go a.scan()
+}
+
+// Stop ends the scan process and waits for it to return.
+func (a *AntiEntropy) Stop() {
+	close(a.stop)
+	<-a.done
+}
+
+// shared returns the ranges replicated on both the current node and peer.
+func (a *AntiEntropy) shared(ranges map[string]ring.PreferenceList, peer string) []string {
+	tokens := []string{}
+
+	for token, nodes := range ranges {
+		if nodes.Contains(a.store.rpcAddress()) && nodes.Contains(peer) {
+			tokens = append(tokens, token)
+		}
+	}
+
+	return tokens
+}
+
+// add includes the key's value in the tree of its range. The caller must
+// hold a.lock.
+func (a *AntiEntropy) add(key string, value *data.Data) {
+	token := a.store.Ring.Range(key)
+	r, ok := a.trees[token]
+
+	if !ok {
+		a.stale = true
+		return
+	}
+
+	digest := value.Digest()
+	r.tree.Add(key, digest)
+	r.keys[key] = digest
+	r.dirty = true
+	a.ranges[key] = token
+}
+
+// remove takes the key out of the tree it was added to. The caller must
+// hold a.lock.
+func (a *AntiEntropy) remove(key string) {
+	token, ok := a.ranges[key]
+
+	if !ok {
+		return
+	}
+
+	r := a.trees[token]
+	r.tree.Remove(key, r.keys[key])
+	delete(r.keys, key)
+	r.dirty = true
+	delete(a.ranges, key)
+}
+
+// Update replaces the key's value in the trees. value is nil if the key
+// was deleted.
+// It's called with the store's lock held, so updates to the same key are
+// applied in the order they were stored.
+func (a *AntiEntropy) Update(key string, value *data.Data) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.trees == nil {
+		return
+	}
+
+	a.remove(key)
+
+	if value != nil {
+		a.add(key, value)
+	}
+}
+
+// refresh rebuilds the trees from the Store if the ring's ranges have
+// changed since they were built.
+func (a *AntiEntropy) refresh(ranges map[string]ring.PreferenceList) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	current := a.trees != nil && !a.stale && len(a.trees) == len(ranges)
+
+	for token := range ranges {
+		if _, ok := a.trees[token]; !ok {
+			current = false
+		}
+	}
+
+	if current {
+		return
+	}
+
+	a.trees = map[string]*rangeTree{}
+	a.ranges = map[string]string{}
+	a.stale = false
+
+	for token := range ranges {
+		a.trees[token] = &rangeTree{tree: merkle.New(merkleDepth), keys: map[string][]byte{}}
+	}
+
+	for _, key := range a.store.Data.Keys() {
+		if value, ok := a.store.Data.Get(key); ok {
+			a.add(key, value)
+		}
+	}
+}
+
+// Trees returns a copy of the tree of each range the current node shares
+// with peer.
+func (a *AntiEntropy) Trees(peer string) map[string]*merkle.Tree {
+	ranges := a.store.Ring.Ranges(a.store.ReplicationLevel)
+	a.refresh(ranges)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	trees := map[string]*merkle.Tree{}
+
+	for _, token := range a.shared(ranges, peer) {
+		r, ok := a.trees[token]
+
+		if !ok {
+			continue
+		}
+
+		if r.dirty {
+			r.tree.Build()
+			r.dirty = false
+		}
+
+		trees[token] = r.tree.Copy()
+	}
+
+	return trees
+}
+
+// Items returns the values of the keys in the leaves of each range, as
+// long as the range is shared with peer.
+func (a *AntiEntropy) Items(peer string, leaves map[string][]int) []*data.Data {
+	ranges := a.store.Ring.Ranges(a.store.ReplicationLevel)
+	a.refresh(ranges)
+
+	keys := []string{}
+	a.lock.Lock()
+
+	for _, token := range a.shared(ranges, peer) {
+		r, ok := a.trees[token]
+
+		if !ok || len(leaves[token]) == 0 {
+			continue
+		}
+
+		wanted := map[int]bool{}
+
+		for _, leaf := range leaves[token] {
+			wanted[leaf] = true
+		}
+
+		for key := range r.keys {
+			if wanted[r.tree.Leaf(key)] {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	a.lock.Unlock()
+
+	items := []*data.Data{}
+
+	for _, key := range keys {
+		if value, ok := a.store.Data.Get(key); ok {
+			items = append(items, value)
+		}
+	}
+
+	return items
+}
+
+// Merge adds items received from another replica and returns the number
+// that changed the local data. Returns ErrDecommissioning without merging
+// anything if the node is leaving the cluster.
+func (a *AntiEntropy) Merge(items []*data.Data) (int, error) {
+	if a.store.decommissioning.Load() {
+		return 0, ErrDecommissioning
+	}
+
+	changed := 0
+
+	for _, item := range items {
+		if a.store.Merge(item) {
+			changed++
+		}
+	}
+
+	a.store.Metrics.AntiEntropyMerges.Add(int64(changed))
+
+	return changed, nil
+}
+
+// Exchange compares the trees of the ranges shared with peer and swaps the
+// values in any leaves that differ. A range only one of the nodes has a
+// tree for differs in every leaf.
+func (a *AntiEntropy) Exchange(peer string) error {
+	ctx := context.Background()
+	remote, err := a.client.MerkleTrees(ctx, peer, a.store.rpcAddress())
+
+	if err != nil {
+		return err
+	}
+
+	local := a.Trees(peer)
+	leaves := map[string][]int{}
+	count := 0
+
+	for token, tree := range local {
+		diff := tree.All()
+
+		if other, ok := remote[token]; ok {
+			diff = merkle.Diff(tree, other)
+		}
+
+		if len(diff) > 0 {
+			leaves[token] = diff
+			count += len(diff)
+		}
+	}
+
+	for token, tree := range remote {
+		if _, ok := local[token]; !ok {
+			leaves[token] = tree.All()
+			count += len(leaves[token])
+		}
+	}
+
+	if count == 0 {
+		return nil
+	}
+
+	items := a.Items(peer, leaves)
+	theirs, err := a.client.MerkleSync(ctx, peer, a.store.rpcAddress(), leaves, items)
+
+	if err != nil {
+		return err
+	}
+
+	changed, err := a.Merge(theirs)
+
+	if err != nil {
+		return err
+	}
+
+	a.store.log.Printf("Anti-entropy with %s: %d leaves differ in %d ranges, sent %d items, merged %d of %d", peer, count, len(leaves), len(items), changed, len(theirs))
+
+	return nil
+}
+
+// NewAntiEntropy returns a new instance using the AntiEntropyInterval
+// defined in config.
+func NewAntiEntropy(config Config, store *Toystore, client TreeExchanger) *AntiEntropy {
+	a := &AntiEntropy{
+		ScanInterval: config.AntiEntropyInterval,
+		store:        store,
+		client:       client,
+		lock:         &sync.Mutex{},
+		stop:         make(chan bool),
+		done:         make(chan bool),
+	}
+
+	if a.ScanInterval == 0 {
+		a.ScanInterval = DefaultAntiEntropyInterval
+	}
+
+	return a
+}
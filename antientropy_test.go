@@ -0,0 +1,110 @@
+package toystore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rlayte/toystore/data"
+	"github.com/rlayte/toystore/merkle"
+)
+
+// FakeExchanger implements TreeExchanger by calling another node's
+// AntiEntropy directly.
+type FakeExchanger struct {
+	peers map[string]*Toystore
+}
+
+func (f *FakeExchanger) MerkleTrees(ctx context.Context, address string, peer string) (map[string]*merkle.Tree, error) {
+	return f.peers[address].AntiEntropy.Trees(peer), nil
+}
+
+func (f *FakeExchanger) MerkleSync(ctx context.Context, address string, peer string, leaves map[string][]int, items []*data.Data) ([]*data.Data, error) {
+	theirs := f.peers[address].AntiEntropy.Items(peer, leaves)
+	_, err := f.peers[address].AntiEntropy.Merge(items)
+	return theirs, err
+}
+
+func TestAntiEntropyExchange(t *testing.T) {
+	exchanger := &FakeExchanger{map[string]*Toystore{}}
+	a, b := newLocalNode(), newLocalNode()
+	b.Host = "127.0.0.2"
+
+	for _, node := range []*Toystore{a, b} {
+		node.ReplicationLevel = 2
+		node.Ring.Add("127.0.0.1:3001")
+		node.Ring.Add("127.0.0.2:3001")
+		node.AntiEntropy = NewAntiEntropy(Config{}, node, exchanger)
+		exchanger.peers[node.rpcAddress()] = node
+	}
+
+	for _, key := range []string{"foo", "bar", "baz"} {
+		a.Merge(data.New(key, "a"))
+	}
+
+	b.Merge(data.New("qux", "b"))
+
+	if err := a.AntiEntropy.Exchange(b.rpcAddress()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"foo", "bar", "baz", "qux"} {
+		if _, ok := a.Data.Get(key); !ok {
+			t.Errorf("%s should be on a", key)
+		}
+
+		if _, ok := b.Data.Get(key); !ok {
+			t.Errorf("%s should be on b", key)
+		}
+	}
+
+	assertTreesEqual(t, a.AntiEntropy.Trees(b.rpcAddress()), b.AntiEntropy.Trees(a.rpcAddress()))
+}
+
+func assertTreesEqual(t *testing.T, a, b map[string]*merkle.Tree) {
+	if len(a) != len(b) {
+		t.Fatalf("Nodes should share the same ranges, got %d and %d", len(a), len(b))
+	}
+
+	for token, tree := range a {
+		if other, ok := b[token]; !ok || len(merkle.Diff(tree, other)) != 0 {
+			t.Errorf("Trees for range %s should be equal", token)
+		}
+	}
+}
+
+func TestAntiEntropyUpdate(t *testing.T) {
+	node := newLocalNode()
+	node.ReplicationLevel = 2
+	node.Ring.Add("127.0.0.1:3001")
+	node.Ring.Add("127.0.0.2:3001")
+	node.AntiEntropy = NewAntiEntropy(Config{}, node, nil)
+	gc := &GarbageCollector{store: node}
+
+	write := func(value *data.Data) {
+		node.version(value)
+		node.Merge(value)
+	}
+
+	for _, key := range []string{"foo", "bar", "baz"} {
+		write(data.New(key, "a"))
+	}
+
+	// Build the trees, then change the data they were built from.
+	node.AntiEntropy.Trees("127.0.0.2:3001")
+
+	write(data.New("qux", "b"))
+	write(data.New("foo", "b"))
+	write(data.NewTombstone("bar"))
+	gc.Collect()
+
+	if _, ok := node.Data.Get("bar"); ok {
+		t.Fatal("bar should have been collected")
+	}
+
+	updated := node.AntiEntropy.Trees("127.0.0.2:3001")
+
+	// Rebuilding from the Store should give the same trees.
+	rebuilt := NewAntiEntropy(Config{}, node, nil)
+
+	assertTreesEqual(t, updated, rebuilt.Trees("127.0.0.2:3001"))
+}
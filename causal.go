@@ -0,0 +1,60 @@
+package toystore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/rlayte/toystore/data"
+)
+
+// CausalContext is an opaque summary of the versions of a key returned by
+// GetVersions. Writing with it supersedes exactly those versions.
+//
+// It can be marshalled to text so clients outside the process can hold on
+// to it between a read and a write.
+type CausalContext struct {
+	clock data.VectorClock
+}
+
+// MarshalText encodes the context as a base64 string.
+func (c CausalContext) MarshalText() ([]byte, error) {
+	raw, err := json.Marshal(c.clock)
+
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, base64.URLEncoding.EncodedLen(len(raw)))
+	base64.URLEncoding.Encode(out, raw)
+
+	return out, nil
+}
+
+// UnmarshalText decodes a context encoded by MarshalText.
+func (c *CausalContext) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		c.clock = data.VectorClock{}
+		return nil
+	}
+
+	raw := make([]byte, base64.URLEncoding.DecodedLen(len(text)))
+	n, err := base64.URLEncoding.Decode(raw, text)
+
+	if err != nil {
+		return err
+	}
+
+	clock := data.VectorClock{}
+
+	if err := json.Unmarshal(raw[:n], &clock); err != nil {
+		return err
+	}
+
+	c.clock = clock
+	return nil
+}
+
+// String returns the context's clock.
+func (c CausalContext) String() string {
+	return c.clock.String()
+}
@@ -0,0 +1,53 @@
+package toystore
+
+import "testing"
+
+func TestPutVersionKeepsConcurrentWrites(t *testing.T) {
+	node := newLocalNode()
+	node.Put("cart", "a")
+
+	values, context, ok := node.GetVersions("cart")
+
+	if !ok || len(values) != 1 {
+		t.Fatalf("Should find one version, found %v", values)
+	}
+
+	node.PutVersion("cart", "b", context)
+	node.PutVersion("cart", "c", context)
+
+	values, context, _ = node.GetVersions("cart")
+
+	if len(values) != 2 {
+		t.Fatalf("Writes with the same context should be siblings, found %v", values)
+	}
+
+	node.PutVersion("cart", "bc", context)
+
+	values, _, _ = node.GetVersions("cart")
+
+	if len(values) != 1 || values[0] != "bc" {
+		t.Errorf("Write with the merged context should replace siblings, found %v", values)
+	}
+}
+
+func TestCausalContextText(t *testing.T) {
+	node := newLocalNode()
+	node.Put("foo", "bar")
+	_, context, _ := node.GetVersions("foo")
+
+	text, err := context.MarshalText()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := CausalContext{}
+
+	if err := decoded.UnmarshalText(text); err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.String() != context.String() {
+		t.Errorf("%s != %s", decoded, context)
+	}
+}
@@ -1,21 +1,30 @@
 package toystore
 
 import (
-	"log"
+	"context"
+	"errors"
 	"net/rpc"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rlayte/toystore/data"
+	"github.com/rlayte/toystore/merkle"
 )
 
 // PeerClient defines the possible interactions between nodes in the cluster.
 // Should be implemented with a specific transport client.
+//
+// Every call is bounded by its context. The context's deadline is sent to
+// the remote node so coordinators stop waiting for replicas at the same
+// time as the caller.
 type PeerClient interface {
-	Get(address string, key string) (value *data.Data, status bool)
-	Put(address string, value *data.Data) (status bool)
-	CoordinateGet(address string, key string) (value *data.Data, status bool)
-	CoordinatePut(address string, value *data.Data) (status bool)
-	HintPut(address string, hint string, value *data.Data) (status bool)
+	Get(ctx context.Context, address string, key string) (value *data.Data, err error)
+	Put(ctx context.Context, address string, value *data.Data) (err error)
+	CoordinateGet(ctx context.Context, address string, key string, r int) (value *data.Data, err error)
+	CoordinatePut(ctx context.Context, address string, value *data.Data, w int) (err error)
+	HintPut(ctx context.Context, address string, hint string, value *data.Data) (err error)
+	HintGet(ctx context.Context, address string, hint string, key string) (value *data.Data, err error)
 }
 
 // Transferrer defines the method for transferring blocks of data between
@@ -24,126 +33,355 @@ type Transferrer interface {
 	Transfer(address string, data []*data.Data) (status bool)
 }
 
-// dial attempts to connect to a specified RPC server.
-// It will retry every 1/3 seconds if connection fails.
-// If it can't connect within 1 second it aborts and panics.
-func dial(address string) *rpc.Client {
-	var err error
-	var conn *rpc.Client
-	success := make(chan *rpc.Client)
+// deadline returns the context's deadline or the zero time if it has none.
+func deadline(ctx context.Context) time.Time {
+	d, _ := ctx.Deadline()
+	return d
+}
 
-	go func() {
-		conn, err = rpc.Dial("tcp", address)
+// replyError converts the status of a coordinator's reply to an error.
+func replyError(op string, ok bool, timeout bool, acks int, required int) error {
+	if ok {
+		return nil
+	}
 
-		for err != nil {
-			conn, err = rpc.Dial("tcp", address)
-			time.Sleep(time.Second / 3)
-		}
+	if timeout {
+		return ErrTimeout
+	}
 
-		success <- conn
-	}()
+	return &QuorumError{op, acks, required}
+}
 
-	select {
-	case conn := <-success:
-		return conn
-	case <-time.After(time.Second):
-		log.Printf("Failed to dial address: %s", address)
-		return nil
+// RpcClient implements PeerClient using Go's RPC package.
+// It keeps a pool of persistent connections to each peer. Broken
+// connections are discarded, peers that refuse connections are retried with
+// exponential backoff, and idle connections are checked periodically.
+type RpcClient struct {
+	// Maximum time to wait for a new connection.
+	DialTimeout time.Duration
+
+	// Maximum time to wait for a reply. The caller's context can shorten
+	// this.
+	CallTimeout time.Duration
+
+	// Number of connections to keep open to each peer.
+	ConnectionsPerPeer int
+
+	// Time between health checks of open connections.
+	HealthCheckInterval time.Duration
+
+	pools map[string]*peerPool
+	lock  *sync.Mutex
+
+	// Last batch number used to match transfers with their
+	// acknowledgements.
+	batch atomic.Uint64
+
+	stop chan bool
+	done chan bool
+}
+
+// pool returns the connection pool for the address, creating it if needed.
+func (r *RpcClient) pool(address string) *peerPool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	pool, ok := r.pools[address]
+
+	if !ok {
+		pool = &peerPool{
+			address: address,
+			size:    r.ConnectionsPerPeer,
+			lock:    &sync.Mutex{},
+		}
+		r.pools[address] = pool
 	}
+
+	return pool
 }
 
-// call attempts to make an RPC.
-// If the connection fails it returns false, otherwise true.
-func call(address string, method string, args interface{}, reply interface{}) bool {
+// call attempts to make an RPC using a pooled connection.
+// If the connection turns out to be broken it's discarded and the call is
+// retried once on a new connection.
+// If the node can't be reached it returns an UnreachableError. If the
+// context is done before the reply arrives it returns the context's error,
+// and if CallTimeout passes first it returns ErrTimeout.
+func (r *RpcClient) call(ctx context.Context, address string, method string, args interface{}, reply interface{}) error {
+	return r.invoke(ctx, r.CallTimeout, address, method, args, reply)
+}
+
+// invoke makes an RPC like call but waits at most timeout for the reply. If
+// timeout is 0 the call is only bounded by the context, which is used for
+// long running admin operations.
+func (r *RpcClient) invoke(ctx context.Context, timeout time.Duration, address string, method string, args interface{}, reply interface{}) error {
 	if address == "" {
-		return false
+		return &UnreachableError{address, errors.New("no address")}
 	}
 
-	conn := dial(address)
-
-	if conn == nil {
-		return false
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
 
-	err := conn.Call(method, args, reply)
-	conn.Close()
+	pool := r.pool(address)
+	var err error
 
-	if err != nil {
-		return false
+	for attempt := 0; attempt < 2; attempt++ {
+		var client *rpc.Client
+		client, err = pool.get(ctx, r.DialTimeout)
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return contextError(ctx)
+			}
+
+			return &UnreachableError{address, err}
+		}
+
+		pending := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+
+		select {
+		case <-ctx.Done():
+			return contextError(ctx)
+		case result := <-pending.Done:
+			if _, ok := result.Error.(rpc.ServerError); ok || result.Error == nil {
+				return result.Error
+			}
+
+			err = result.Error
+			pool.remove(client)
+		}
 	}
 
-	return true
+	return &UnreachableError{address, err}
 }
 
-// RpcClient implements PeerClient using Go's RPC package.
-type RpcClient struct {
+// healthCheck periodically pings every open connection and discards the
+// ones that fail. It returns once Close is called.
+func (r *RpcClient) healthCheck() {
+	defer close(r.done)
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-time.After(r.HealthCheckInterval):
+		}
+
+		r.lock.Lock()
+		pools := []*peerPool{}
+		for _, pool := range r.pools {
+			pools = append(pools, pool)
+		}
+		r.lock.Unlock()
+
+		for _, pool := range pools {
+			for _, client := range pool.all() {
+				pending := client.Go("RpcHandler.Ping", &PingArgs{}, &PingReply{}, make(chan *rpc.Call, 1))
+
+				select {
+				case result := <-pending.Done:
+					if result.Error == nil {
+						continue
+					}
+				case <-time.After(r.CallTimeout):
+				}
+
+				pool.remove(client)
+			}
+		}
+	}
+}
+
+// Close stops the health checks and closes every pooled connection.
+func (r *RpcClient) Close() error {
+	close(r.stop)
+	<-r.done
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for address, pool := range r.pools {
+		pool.close()
+		delete(r.pools, address)
+	}
+
+	return nil
 }
 
 // Get makes an RPC to the address to find the specified key and returns
-// the value and an existence bool.
-func (r *RpcClient) Get(address string, key string) (*data.Data, bool) {
-	args := &GetArgs{key}
+// the value, or nil if the node doesn't have it.
+func (r *RpcClient) Get(ctx context.Context, address string, key string) (*data.Data, error) {
+	args := &GetArgs{key, deadline(ctx), "", 0}
 	reply := &GetReply{}
 
-	call(address, "RpcHandler.Get", args, reply)
+	if err := r.call(ctx, address, "RpcHandler.Get", args, reply); err != nil {
+		return nil, err
+	}
 
-	return reply.Value, reply.Ok
+	return reply.Value, nil
 }
 
-// Put makes an RPC to the address to add the Data value and returns a boolean
-// representing the status of this operation.
-func (r *RpcClient) Put(address string, value *data.Data) bool {
-	args := &PutArgs{value}
-	reply := &PutReply{}
+// HintGet makes an RPC to read the key from a node standing in for the
+// failed hint address. The node returns its own value merged with any hint
+// it holds for the key.
+func (r *RpcClient) HintGet(ctx context.Context, address string, hint string, key string) (*data.Data, error) {
+	args := &GetArgs{key, deadline(ctx), hint, 0}
+	reply := &GetReply{}
 
-	call(address, "RpcHandler.Put", args, reply)
+	if err := r.call(ctx, address, "RpcHandler.HintGet", args, reply); err != nil {
+		return nil, err
+	}
 
-	return reply.Ok
+	return reply.Value, nil
+}
+
+// Put makes an RPC to the address to add the Data value and returns an
+// error if the node couldn't be reached.
+func (r *RpcClient) Put(ctx context.Context, address string, value *data.Data) error {
+	args := &PutArgs{value, deadline(ctx), 0}
+	reply := &PutReply{}
+
+	return r.call(ctx, address, "RpcHandler.Put", args, reply)
 }
 
 // CoordinateGet forwards the key to the coordinating node so it can organize
-// the Get operation.
-func (r *RpcClient) CoordinateGet(address string, key string) (*data.Data, bool) {
-	args := &GetArgs{key}
+// the Get operation, waiting for reads successful reads.
+func (r *RpcClient) CoordinateGet(ctx context.Context, address string, key string, reads int) (*data.Data, error) {
+	args := &GetArgs{key, deadline(ctx), "", reads}
 	reply := &GetReply{}
 
-	call(address, "RpcHandler.CoordinateGet", args, reply)
+	if err := r.call(ctx, address, "RpcHandler.CoordinateGet", args, reply); err != nil {
+		return nil, err
+	}
 
-	return reply.Value, reply.Ok
+	return reply.Value, replyError("GET", reply.Ok, reply.Timeout, reply.Acks, reply.Required)
 }
 
 // CoordinatePut forwards the Data value to the coordinating node so it can organize
-// the Put operation.
-func (r *RpcClient) CoordinatePut(address string, value *data.Data) bool {
-	args := &PutArgs{value}
+// the Put operation, waiting for writes successful writes.
+func (r *RpcClient) CoordinatePut(ctx context.Context, address string, value *data.Data, writes int) error {
+	args := &PutArgs{value, deadline(ctx), writes}
 	reply := &PutReply{}
 
-	call(address, "RpcHandler.CoordinatePut", args, reply)
+	if err := r.call(ctx, address, "RpcHandler.CoordinatePut", args, reply); err != nil {
+		return err
+	}
 
-	return reply.Ok
+	return replyError("PUT", reply.Ok, reply.Timeout, reply.Acks, reply.Required)
 }
 
 // HintPut makes an RPC to add hint data to the specified node.
-func (r *RpcClient) HintPut(address string, hint string, data *data.Data) bool {
+func (r *RpcClient) HintPut(ctx context.Context, address string, hint string, data *data.Data) error {
 	args := &HintArgs{data, hint}
 	reply := &HintReply{}
 
-	call(address, "RpcHandler.HintPut", args, reply)
+	return r.call(ctx, address, "RpcHandler.HintPut", args, reply)
+}
+
+// MerkleTrees makes an RPC to get the Merkle trees of the ranges the node at
+// address shares with peer.
+func (r *RpcClient) MerkleTrees(ctx context.Context, address string, peer string) (map[string]*merkle.Tree, error) {
+	args := &MerkleTreesArgs{peer}
+	reply := &MerkleTreesReply{}
 
-	return reply.Ok
+	if err := r.call(ctx, address, "RpcHandler.MerkleTrees", args, reply); err != nil {
+		return nil, err
+	}
+
+	return reply.Trees, nil
+}
+
+// MerkleSync makes an RPC to send the items in the leaves that differ and
+// returns the other node's items for the same leaves.
+func (r *RpcClient) MerkleSync(ctx context.Context, address string, peer string, leaves map[string][]int, items []*data.Data) ([]*data.Data, error) {
+	args := &MerkleSyncArgs{peer, leaves, items}
+	reply := &MerkleSyncReply{}
+
+	if err := r.call(ctx, address, "RpcHandler.MerkleSync", args, reply); err != nil {
+		return nil, err
+	}
+
+	return reply.Data, nil
+}
+
+// Ranges makes an RPC to get a page of up to limit keys after start that
+// the node at address stores and peer is a replica for. Weight is peer's
+// capacity weight, used if the node hasn't seen peer join yet. It also
+// returns the start of the next page, or an empty string after the last
+// page.
+func (r *RpcClient) Ranges(ctx context.Context, address string, peer string, weight int, start string, limit int) ([]*data.Data, string, error) {
+	args := &RangesArgs{peer, weight, start, limit}
+	reply := &RangesReply{}
+
+	if err := r.call(ctx, address, "RpcHandler.Ranges", args, reply); err != nil {
+		return nil, "", err
+	}
+
+	return reply.Data, reply.Next, nil
+}
+
+// Decommission makes an RPC asking the node at address to stream its
+// ranges to their new owners and remove itself from the ring. It returns
+// once the ranges have been streamed, and is only bounded by the context.
+// The node's process can be stopped afterwards.
+func (r *RpcClient) Decommission(ctx context.Context, address string) error {
+	return r.invoke(ctx, 0, address, "RpcHandler.Decommission", &DecommissionArgs{}, &DecommissionReply{})
+}
+
+// Bootstrap makes an RPC asking the node at address to stream its ranges
+// from the other nodes. It returns once the node serves reads again, and is
+// only bounded by the context.
+func (r *RpcClient) Bootstrap(ctx context.Context, address string) error {
+	return r.invoke(ctx, 0, address, "RpcHandler.Bootstrap", &BootstrapArgs{}, &BootstrapReply{})
 }
 
 // Transfer makes an RPC call to send a set of keys to the specified address.
+// It returns true once the node acknowledges it has stored every key.
 func (r *RpcClient) Transfer(address string, data []*data.Data) bool {
-	args := &TransferArgs{data}
+	args := &TransferArgs{data, r.batch.Add(1)}
 	reply := &TransferReply{}
 
-	call(address, "RpcHandler.Transfer", args, reply)
+	if err := r.call(context.Background(), address, "RpcHandler.Transfer", args, reply); err != nil {
+		return false
+	}
 
-	return reply.Ok
+	return reply.Ok && reply.Batch == args.Batch
 }
 
-// NewRpcClient returns a new RpcClient instance.
-func NewRpcClient() *RpcClient {
-	return &RpcClient{}
+// NewRpcClient returns a new RpcClient instance using the timeouts and
+// pool size defined in config, and starts checking the health of its
+// connections.
+func NewRpcClient(config Config) *RpcClient {
+	r := &RpcClient{
+		DialTimeout:         config.DialTimeout,
+		CallTimeout:         config.CallTimeout,
+		ConnectionsPerPeer:  config.ConnectionsPerPeer,
+		HealthCheckInterval: config.HealthCheckInterval,
+		pools:               map[string]*peerPool{},
+		lock:                &sync.Mutex{},
+		stop:                make(chan bool),
+		done:                make(chan bool),
+	}
+
+	if r.DialTimeout == 0 {
+		r.DialTimeout = DefaultDialTimeout
+	}
+
+	if r.CallTimeout == 0 {
+		r.CallTimeout = DefaultCallTimeout
+	}
+
+	if r.ConnectionsPerPeer == 0 {
+		r.ConnectionsPerPeer = DefaultConnectionsPerPeer
+	}
+
+	if r.HealthCheckInterval == 0 {
+		r.HealthCheckInterval = DefaultHealthCheckInterval
+	}
+
+	go r.healthCheck()
+
+	return r
 }
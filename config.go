@@ -7,6 +7,8 @@ import (
 )
 
 // Config defines the variables used for a Toystore node.
+// Fields left at their zero value use the default documented on each
+// field.
 type Config struct {
 	// Number of nodes to store a key on.
 	ReplicationLevel int
@@ -23,7 +25,8 @@ type Config struct {
 	RPCPort int
 
 	// GossipPort is the port Toystore will use for membership updates via
-	// its gossip protocol.
+	// its gossip protocol. Defaults to memberlist's port, 7946. A seed
+	// address without a port is assumed to use the same port.
 	GossipPort int
 
 	// Host is the ip Toystore will bind to.
@@ -37,6 +40,153 @@ type Config struct {
 	// data.
 	Store store.Store
 
-	// HandoffInterval is the time between scans of the hinted handoff list.
+	// Resolver reconciles concurrent versions of a key when replicas
+	// diverge. E.g. LastWriteWins, MaxValue, SetUnion or a ResolverFunc.
+	// If nil, concurrent versions are kept as siblings and returned by
+	// GetVersions.
+	Resolver Resolver
+
+	// ReadRepair controls how replicas that return stale data to a read are
+	// updated. Defaults to ReadRepairAsync.
+	ReadRepair ReadRepairMode
+
+	// Coordinator controls which node in a key's preference list
+	// coordinates requests for it. Defaults to CoordinatorFirst.
+	Coordinator CoordinatorStrategy
+
+	// Tokens is the number of positions (virtual nodes) each node owns in
+	// the hash ring. More tokens spread keys more evenly. Every node in a
+	// cluster must use the same value. Defaults to DefaultTokens.
+	Tokens int
+
+	// Weight is the capacity of this node relative to the others. A node
+	// with weight 2 owns twice as many ranges as a node with weight 1.
+	// Defaults to 1.
+	Weight int
+
+	// TransferChunkSize is the number of keys sent in each message when
+	// streaming ranges to other nodes. Defaults to
+	// DefaultTransferChunkSize.
+	TransferChunkSize int
+
+	// TransferRetryInterval is the time between attempts to resume streams
+	// to nodes that couldn't be reached. Defaults to
+	// DefaultTransferRetryInterval.
+	TransferRetryInterval time.Duration
+
+	// TransferRetries is the number of times a chunk that isn't
+	// acknowledged is resent before the stream is paused until the next
+	// retry interval. Defaults to DefaultTransferRetries; a negative value
+	// disables retries.
+	TransferRetries int
+
+	// TransferRateLimit is the maximum number of keys per second streamed
+	// to other nodes, so rebalancing doesn't starve requests. 0 means
+	// unlimited.
+	TransferRateLimit int
+
+	// TransferProgress is called after every chunk streamed to another
+	// node is acknowledged. May be nil. Streams to different nodes call it
+	// concurrently.
+	TransferProgress func(TransferProgress)
+
+	// HandoffInterval is the maximum time between attempts to deliver hints
+	// to a node that's alive. Hints are delivered as soon as a node rejoins
+	// and failed deliveries are retried with exponential backoff up to this
+	// interval. Defaults to DefaultHandoffInterval.
 	HandoffInterval time.Duration
+
+	// HintStore persists hints for nodes that are down so they survive
+	// restarts. It can use the same backend as Store but must not share its
+	// keys. Defaults to a namespace of Store, so hints are as durable as
+	// the node's data.
+	HintStore store.Store
+
+	// MaxHints is the number of hints kept for each node that's down. Once
+	// it's reached the oldest hints are dropped. Defaults to
+	// DefaultMaxHints.
+	MaxHints int
+
+	// MaxHintAge is how long hints are kept before they're dropped.
+	// Anti-entropy repairs nodes that miss hints. Defaults to
+	// DefaultMaxHintAge.
+	MaxHintAge time.Duration
+
+	// Bootstrap streams the node's ranges from the rest of the cluster when
+	// it starts, refusing reads until it finishes. Use it when adding a
+	// node to a cluster that already has data.
+	Bootstrap bool
+
+	// RemovalTimeout is how long a node can be gone before it's removed
+	// from the ring permanently and its ranges are re-replicated to other
+	// nodes. Nodes that rejoin before then keep their ranges. Defaults to
+	// DefaultRemovalTimeout.
+	RemovalTimeout time.Duration
+
+	// AntiEntropyInterval is the time between Merkle tree exchanges with
+	// other nodes. Defaults to DefaultAntiEntropyInterval.
+	AntiEntropyInterval time.Duration
+
+	// DialTimeout is the maximum time to wait when connecting to another
+	// node. Defaults to DefaultDialTimeout.
+	DialTimeout time.Duration
+
+	// CallTimeout is the maximum time to wait for a reply from another node.
+	// Defaults to DefaultCallTimeout.
+	CallTimeout time.Duration
+
+	// ConnectionsPerPeer is the number of persistent connections to keep
+	// open to each node. Defaults to DefaultConnectionsPerPeer.
+	ConnectionsPerPeer int
+
+	// HealthCheckInterval is the time between checks of open connections.
+	// Defaults to DefaultHealthCheckInterval.
+	HealthCheckInterval time.Duration
+
+	// TombstoneGracePeriod is how long deleted keys are remembered before
+	// they're purged. It should be longer than any node is expected to be
+	// unavailable, otherwise a stale replica can resurrect deleted keys.
+	// Defaults to DefaultTombstoneGracePeriod.
+	TombstoneGracePeriod time.Duration
+
+	// GCInterval is the time between scans for expired tombstones.
+	// Defaults to DefaultGCInterval.
+	GCInterval time.Duration
+}
+
+// validate checks the config can be used to start a node.
+func (c Config) validate() error {
+	if c.Store == nil {
+		return &ConfigError{"Store", "must be set"}
+	}
+
+	if c.ReplicationLevel < 1 {
+		return &ConfigError{"ReplicationLevel", "must be at least 1"}
+	}
+
+	if c.W < 1 || c.W > c.ReplicationLevel {
+		return &ConfigError{"W", "must be between 1 and ReplicationLevel"}
+	}
+
+	if c.R < 1 || c.R > c.ReplicationLevel {
+		return &ConfigError{"R", "must be between 1 and ReplicationLevel"}
+	}
+
+	if c.Weight < 0 {
+		return &ConfigError{"Weight", "must not be negative"}
+	}
+
+	if c.Tokens < 0 {
+		return &ConfigError{"Tokens", "must not be negative"}
+	}
+
+	if c.MaxHints < 0 {
+		return &ConfigError{"MaxHints", "must not be negative"}
+	}
+
+	if c.TransferRateLimit < 0 {
+		return &ConfigError{"TransferRateLimit", "must not be negative"}
+	}
+
+	return nil
 }
@@ -0,0 +1,31 @@
+package toystore
+
+import (
+	"testing"
+
+	"github.com/rlayte/toystore/store/memory"
+)
+
+func TestNewInvalidConfig(t *testing.T) {
+	cases := map[string]Config{
+		"Store":             {ReplicationLevel: 3, W: 1, R: 1},
+		"ReplicationLevel":  {Store: memory.New(), W: 1, R: 1},
+		"W":                 {Store: memory.New(), ReplicationLevel: 3, W: 4, R: 1},
+		"R":                 {Store: memory.New(), ReplicationLevel: 3, W: 1, R: 0},
+		"Weight":            {Store: memory.New(), ReplicationLevel: 3, W: 1, R: 1, Weight: -1},
+		"Tokens":            {Store: memory.New(), ReplicationLevel: 3, W: 1, R: 1, Tokens: -1},
+		"MaxHints":          {Store: memory.New(), ReplicationLevel: 3, W: 1, R: 1, MaxHints: -1},
+		"TransferRateLimit": {Store: memory.New(), ReplicationLevel: 3, W: 1, R: 1, TransferRateLimit: -1},
+	}
+
+	for field, config := range cases {
+		_, err := New(config)
+		configErr, ok := err.(*ConfigError)
+
+		if !ok {
+			t.Errorf("Expected ConfigError for %s, got %v", field, err)
+		} else if configErr.Field != field {
+			t.Errorf("Expected error for %s, got %s", field, configErr.Field)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package toystore
+
+// Consistency is the number of replicas a single Get or Put waits for,
+// relative to ReplicationLevel.
+type Consistency int
+
+const (
+	// ConsistencyDefault uses the node's R for reads and W for writes.
+	ConsistencyDefault Consistency = iota
+
+	// ConsistencyOne waits for a single replica.
+	ConsistencyOne
+
+	// ConsistencyQuorum waits for a majority of ReplicationLevel replicas.
+	ConsistencyQuorum
+
+	// ConsistencyAll waits for every replica.
+	ConsistencyAll
+)
+
+// Options overrides the consistency of a single request.
+type Options struct {
+	// Consistency sets R for reads and W for writes.
+	Consistency Consistency
+
+	// R and W set the exact number of replicas to read from or write to,
+	// overriding Consistency. They must be between 1 and ReplicationLevel.
+	// Zero means unset.
+	R int
+	W int
+}
+
+// replicas returns the number of replicas the request waits for. explicit
+// is the R or W set in the options, field its name and fallback the node's
+// default.
+func (o Options) replicas(replication int, explicit int, field string, fallback int) (int, error) {
+	if explicit != 0 {
+		if explicit < 1 || explicit > replication {
+			return 0, &OptionsError{field, "must be between 1 and ReplicationLevel"}
+		}
+
+		return explicit, nil
+	}
+
+	switch o.Consistency {
+	case ConsistencyDefault:
+		return fallback, nil
+	case ConsistencyOne:
+		return 1, nil
+	case ConsistencyQuorum:
+		return replication/2 + 1, nil
+	case ConsistencyAll:
+		return replication, nil
+	}
+
+	return 0, &OptionsError{"Consistency", "unknown level"}
+}
+
+// reads returns the number of replicas a read with the options waits for.
+func (t *Toystore) reads(opts Options) (int, error) {
+	return opts.replicas(t.ReplicationLevel, opts.R, "R", t.R)
+}
+
+// writes returns the number of replicas a write with the options waits
+// for.
+func (t *Toystore) writes(opts Options) (int, error) {
+	return opts.replicas(t.ReplicationLevel, opts.W, "W", t.W)
+}
@@ -0,0 +1,88 @@
+package toystore
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestOptionsReplicas(t *testing.T) {
+	node := newLocalNode()
+	node.ReplicationLevel = 5
+	node.R = 2
+	node.W = 4
+
+	cases := []struct {
+		opts   Options
+		reads  int
+		writes int
+	}{
+		{Options{}, 2, 4},
+		{Options{Consistency: ConsistencyOne}, 1, 1},
+		{Options{Consistency: ConsistencyQuorum}, 3, 3},
+		{Options{Consistency: ConsistencyAll}, 5, 5},
+		{Options{Consistency: ConsistencyOne, R: 4, W: 2}, 4, 2},
+	}
+
+	for _, c := range cases {
+		reads, err := node.reads(c.opts)
+
+		if err != nil || reads != c.reads {
+			t.Errorf("%+v should read from %d replicas, got %d (%v)", c.opts, c.reads, reads, err)
+		}
+
+		writes, err := node.writes(c.opts)
+
+		if err != nil || writes != c.writes {
+			t.Errorf("%+v should write to %d replicas, got %d (%v)", c.opts, c.writes, writes, err)
+		}
+	}
+
+	invalid := map[string]Options{
+		"R":           {R: 6},
+		"W":           {W: -1},
+		"Consistency": {Consistency: Consistency(10)},
+	}
+
+	for field, opts := range invalid {
+		_, readErr := node.reads(opts)
+		_, writeErr := node.writes(opts)
+
+		var optsErr *OptionsError
+
+		if !errors.As(readErr, &optsErr) && !errors.As(writeErr, &optsErr) {
+			t.Errorf("Expected OptionsError for %s", field)
+		} else if optsErr.Field != field {
+			t.Errorf("Expected error for %s, got %s", field, optsErr.Field)
+		}
+	}
+}
+
+func TestPutGetWithOptions(t *testing.T) {
+	node, client := newLocalCluster(3)
+	node.Coordinator = CoordinatorLocal
+	client.down["b:3001"] = true
+	ctx := context.Background()
+
+	if err := node.PutWithOptions(ctx, "foo", "bar", Options{Consistency: ConsistencyAll}); !errors.Is(err, ErrQuorumNotMet) {
+		t.Errorf("Writing to all replicas should fail while b is down, got %v", err)
+	}
+
+	if err := node.PutWithOptions(ctx, "foo", "bar", Options{W: 2}); err != nil {
+		t.Errorf("Writing to two replicas should succeed, got %v", err)
+	}
+
+	if _, err := node.GetWithOptions(ctx, "foo", Options{Consistency: ConsistencyAll}); !errors.Is(err, ErrQuorumNotMet) {
+		t.Errorf("Reading from all replicas should fail while b is down, got %v", err)
+	}
+
+	if value, err := node.GetWithOptions(ctx, "foo", Options{Consistency: ConsistencyQuorum}); err != nil || value != "bar" {
+		t.Errorf("Expected bar from a quorum read, got %v (%v)", value, err)
+	}
+
+	var optsErr *OptionsError
+
+	if err := node.PutWithOptions(ctx, "foo", "bar", Options{W: 4}); !errors.As(err, &optsErr) {
+		t.Errorf("W above ReplicationLevel should be rejected, got %v", err)
+	}
+}
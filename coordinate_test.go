@@ -0,0 +1,396 @@
+package toystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rlayte/toystore/data"
+	"github.com/rlayte/toystore/ring"
+	"github.com/rlayte/toystore/store"
+	"github.com/rlayte/toystore/store/memory"
+	"github.com/rlayte/toystore/store/namespace"
+)
+
+// FakePeerClient implements PeerClient by writing directly to other nodes'
+// stores. Hints are kept in a separate store per node. Requests to addresses
+// in down fail as if the node was unreachable.
+type FakePeerClient struct {
+	stores map[string]store.Store
+	hints  map[string]store.Store
+	down   map[string]bool
+	delay  time.Duration
+	lock   *sync.Mutex
+}
+
+func (f *FakePeerClient) peer(ctx context.Context, address string) (store.Store, error) {
+	select {
+	case <-ctx.Done():
+		return nil, contextError(ctx)
+	case <-time.After(f.delay):
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.down[address] {
+		return nil, &UnreachableError{address, errors.New("down")}
+	}
+
+	return f.stores[address], nil
+}
+
+func (f *FakePeerClient) Get(ctx context.Context, address string, key string) (*data.Data, error) {
+	s, err := f.peer(ctx, address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	value, _ := s.Get(key)
+	return value, nil
+}
+
+func (f *FakePeerClient) HintGet(ctx context.Context, address string, hint string, key string) (*data.Data, error) {
+	value, err := f.Get(ctx, address, key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if held, ok := f.hints[address].Get(key); ok {
+		if value == nil {
+			return held, nil
+		}
+
+		return value.Reconcile(held), nil
+	}
+
+	return value, nil
+}
+
+func (f *FakePeerClient) Put(ctx context.Context, address string, value *data.Data) error {
+	s, err := f.peer(ctx, address)
+
+	if err != nil {
+		return err
+	}
+
+	if current, ok := s.Get(value.Key); ok {
+		value = current.Reconcile(value)
+	}
+
+	s.Put(value)
+	return nil
+}
+
+func (f *FakePeerClient) CoordinateGet(ctx context.Context, address string, key string, r int) (*data.Data, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (f *FakePeerClient) CoordinatePut(ctx context.Context, address string, value *data.Data, w int) error {
+	return errors.New("not implemented")
+}
+
+func (f *FakePeerClient) HintPut(ctx context.Context, address string, hint string, value *data.Data) error {
+	if _, err := f.peer(ctx, address); err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.hints[address].Put(value)
+	return nil
+}
+
+// newLocalNode returns a single node Toystore that doesn't serve RPCs or
+// gossip so coordination can be tested in process.
+func newLocalNode() *Toystore {
+	t := &Toystore{
+		ReplicationLevel: 1,
+		W:                1,
+		R:                1,
+		Host:             "127.0.0.1",
+		RPCPort:          3001,
+		Data:             memory.New(),
+		Ring:             ring.NewHashRing(),
+		log:              log.New(ioutil.Discard, "", 0),
+		Metrics:          &Metrics{},
+		meta:             memory.New(),
+		lock:             &sync.Mutex{},
+	}
+
+	t.restore()
+	t.Ring.Add(t.rpcAddress())
+	t.Hints = NewHintedHandoff(Config{}, t.Metrics, nil)
+
+	return t
+}
+
+// newLocalCluster returns a coordinator and a fake client for n-1 peers
+// that every key is replicated to.
+func newLocalCluster(n int) (*Toystore, *FakePeerClient) {
+	t := newLocalNode()
+	t.ReplicationLevel = n
+	client := &FakePeerClient{
+		stores: map[string]store.Store{},
+		hints:  map[string]store.Store{},
+		down:   map[string]bool{},
+		lock:   &sync.Mutex{},
+	}
+	t.client = client
+
+	for i := 1; i < n; i++ {
+		address := string(rune('a'+i)) + ":3001"
+		client.stores[address] = memory.New()
+		client.hints[address] = memory.New()
+		t.Ring.Add(address)
+	}
+
+	return t, client
+}
+
+func TestCoordinateGetNotFound(t *testing.T) {
+	node := newLocalNode()
+
+	_, err := node.GetContext(context.Background(), "missing")
+
+	if err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestCoordinatePutQuorumNotMet(t *testing.T) {
+	node, client := newLocalCluster(3)
+	node.W = 3
+
+	for address := range client.stores {
+		client.down[address] = true
+	}
+
+	err := node.CoordinatePut(context.Background(), data.New("foo", "bar"))
+
+	var quorum *QuorumError
+
+	if !errors.As(err, &quorum) || !errors.Is(err, ErrQuorumNotMet) {
+		t.Fatalf("Expected QuorumError, got %v", err)
+	}
+
+	if quorum.Acks != 1 || quorum.Required != 3 {
+		t.Errorf("Expected 1 of 3 acks, got %d of %d", quorum.Acks, quorum.Required)
+	}
+}
+
+func TestCoordinateGetTimeout(t *testing.T) {
+	node, client := newLocalCluster(3)
+	node.R = 3
+	client.delay = time.Second
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+
+	_, err := node.CoordinateGet(ctx, "foo")
+
+	if err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout, got %v", err)
+	}
+}
+
+func TestCoordinatePutInParallel(t *testing.T) {
+	node, client := newLocalCluster(4)
+	node.W = 4
+	client.delay = time.Millisecond * 50
+
+	start := time.Now()
+	err := node.CoordinatePut(context.Background(), data.New("foo", "bar"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed > client.delay*2 {
+		t.Errorf("Replicas should be written in parallel, but took %s", elapsed)
+	}
+}
+
+func TestCoordinatePutReturnsAtQuorum(t *testing.T) {
+	node, client := newLocalCluster(3)
+	client.delay = time.Millisecond * 50
+
+	start := time.Now()
+	err := node.CoordinatePut(context.Background(), data.New("foo", "bar"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed > client.delay {
+		t.Errorf("Should return once W replicas acknowledge, but took %s", elapsed)
+	}
+
+	time.Sleep(client.delay * 2)
+
+	for address, s := range client.stores {
+		if _, ok := s.Get("foo"); !ok {
+			t.Errorf("Late write should still reach %s", address)
+		}
+	}
+}
+
+func TestCoordinateGetRepairsStaleReplicas(t *testing.T) {
+	node, client := newLocalCluster(3)
+	node.R = 3
+	node.ReadRepair = ReadRepairSync
+
+	value := data.New("foo", "bar")
+	node.version(value)
+	node.Merge(value)
+
+	_, err := node.CoordinateGet(context.Background(), "foo")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for address, s := range client.stores {
+		if _, ok := s.Get("foo"); !ok {
+			t.Errorf("%s should have been repaired", address)
+		}
+	}
+
+	if repairs := node.Metrics.ReadRepairs.Load(); repairs != 2 {
+		t.Errorf("Should have counted 2 repairs, but counted %d", repairs)
+	}
+
+	node.CoordinateGet(context.Background(), "foo")
+
+	if repairs := node.Metrics.ReadRepairs.Load(); repairs != 2 {
+		t.Errorf("Up to date replicas should not be repaired, but counted %d", repairs)
+	}
+}
+
+func TestCoordinateGetReadsHints(t *testing.T) {
+	node, client := newLocalCluster(3)
+	node.ReplicationLevel = 2
+	node.R = 2
+	node.ReadRepair = ReadRepairSync
+	node.Ring.Fail("b:3001")
+	client.down["b:3001"] = true
+
+	// With three nodes both of the others stand in for b on some keys.
+	remote, local := "", ""
+
+	for i := 0; remote == "" || local == ""; i++ {
+		key := fmt.Sprint(i)
+		nodes, _ := node.Ring.FindN(key, node.ReplicationLevel)
+
+		for _, replica := range nodes {
+			if replica.HintFor == "" {
+				continue
+			}
+
+			if replica.Address == node.rpcAddress() && local == "" {
+				local = key
+				node.Hints.Put(data.New(key, "hinted"), "b:3001")
+			} else if replica.Address != node.rpcAddress() && remote == "" {
+				remote = key
+				client.hints[replica.Address].Put(data.New(key, "hinted"))
+			}
+		}
+	}
+
+	for _, key := range []string{remote, local} {
+		value, err := node.CoordinateGet(context.Background(), key)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if value == nil || value.Value != "hinted" {
+			t.Errorf("Hints for b should be read for %s, got %v", key, value)
+		}
+	}
+
+	nodes, _ := node.Ring.FindN(remote, node.ReplicationLevel)
+
+	for _, replica := range nodes {
+		if _, ok := client.stores[replica.Address]; ok && replica.HintFor == "" {
+			if _, ok := client.stores[replica.Address].Get(remote); !ok {
+				t.Errorf("%s should have been repaired", replica.Address)
+			}
+		}
+	}
+}
+
+func TestCoordinatePutAfterRestart(t *testing.T) {
+	node, client := newLocalCluster(3)
+	node.R = 3
+	node.W = 3
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if err := node.CoordinatePut(ctx, data.New("k", "old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Restart the coordinator with an empty store.
+	restarted := newLocalNode()
+	restarted.ReplicationLevel = 3
+	restarted.R = 3
+	restarted.W = 3
+	restarted.Ring = node.Ring
+	restarted.client = client
+
+	if err := restarted.CoordinatePut(ctx, data.New("k", "new")); err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := restarted.CoordinateGet(ctx, "k")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The restarted node has no context for k, so the write is concurrent
+	// with the old value rather than discarded as stale.
+	if value.Live()[0].Value != "new" {
+		t.Errorf("The new write should be kept and returned, got %v with siblings %v", value, value.Siblings)
+	}
+}
+
+func TestCoordinatePutAfterRestartKeepsReplicaID(t *testing.T) {
+	backend := memory.New()
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		// Restart the node over the same store.
+		node := newLocalNode()
+		node.Data = namespace.Exclude(backend, hintNamespace, nodeNamespace)
+		node.meta = namespace.New(backend, nodeNamespace)
+		node.restore()
+
+		if err := node.CoordinatePut(ctx, data.New("k", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	value, _ := backend.Get("k")
+
+	if len(value.Clock) != 1 {
+		t.Errorf("Restarts should reuse the replica ID, got clock %v", value.Clock)
+	}
+
+	if value.Value != 2 || len(value.Siblings) != 0 {
+		t.Errorf("Each write should supersede the last, got %v with siblings %v", value.Value, value.Siblings)
+	}
+}
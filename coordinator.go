@@ -0,0 +1,79 @@
+package toystore
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+// CoordinatorStrategy controls which node in a key's preference list
+// coordinates Get and Put requests for it.
+type CoordinatorStrategy int
+
+const (
+	// CoordinatorFirst forwards every request to the first live node in the
+	// preference list. This is the default.
+	CoordinatorFirst CoordinatorStrategy = iota
+
+	// CoordinatorRandom picks a node from the preference list at random for
+	// each request, spreading load for hot keys across every replica.
+	CoordinatorRandom
+
+	// CoordinatorLeastLoaded picks the node in the preference list with the
+	// fewest requests in flight from this node, so a slow coordinator is
+	// avoided while it catches up.
+	CoordinatorLeastLoaded
+
+	// CoordinatorLocal coordinates on this node if it's in the preference
+	// list, saving a hop. Otherwise it behaves like CoordinatorFirst.
+	CoordinatorLocal
+)
+
+// coordinator returns the address of the node that should coordinate a
+// request for the key according to t.Coordinator.
+func (t *Toystore) coordinator(key string) string {
+	nodes, _ := t.Ring.FindN(key, t.ReplicationLevel)
+
+	if len(nodes) == 0 {
+		return t.Ring.Find(key)
+	}
+
+	switch t.Coordinator {
+	case CoordinatorRandom:
+		return nodes[rand.Intn(len(nodes))].Address
+
+	case CoordinatorLeastLoaded:
+		address, least := "", int64(0)
+
+		for _, node := range nodes {
+			if load := t.load(node.Address).Load(); address == "" || load < least {
+				address, least = node.Address, load
+			}
+		}
+
+		return address
+
+	case CoordinatorLocal:
+		if nodes.Contains(t.rpcAddress()) {
+			return t.rpcAddress()
+		}
+	}
+
+	return nodes[0].Address
+}
+
+// load returns the counter of requests in flight to the address.
+func (t *Toystore) load(address string) *atomic.Int64 {
+	counter, _ := t.inflight.LoadOrStore(address, &atomic.Int64{})
+	return counter.(*atomic.Int64)
+}
+
+// track counts a request to the address as in flight until the returned
+// function is called.
+func (t *Toystore) track(address string) func() {
+	counter := t.load(address)
+	counter.Add(1)
+
+	return func() {
+		counter.Add(-1)
+	}
+}
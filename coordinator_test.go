@@ -0,0 +1,94 @@
+package toystore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestCoordinatorStrategies(t *testing.T) {
+	node, _ := newLocalCluster(4)
+	node.ReplicationLevel = 2
+	local, remote := "", ""
+
+	for i := 0; local == "" || remote == ""; i++ {
+		key := fmt.Sprint(i)
+		nodes, _ := node.Ring.FindN(key, node.ReplicationLevel)
+
+		if nodes.Contains(node.rpcAddress()) && nodes[0].Address != node.rpcAddress() {
+			local = key
+		} else if !nodes.Contains(node.rpcAddress()) {
+			remote = key
+		}
+	}
+
+	first := func(key string) string {
+		nodes, _ := node.Ring.FindN(key, node.ReplicationLevel)
+		return nodes[0].Address
+	}
+
+	if address := node.coordinator(local); address != first(local) {
+		t.Errorf("CoordinatorFirst should pick %s, got %s", first(local), address)
+	}
+
+	node.Coordinator = CoordinatorLocal
+
+	if address := node.coordinator(local); address != node.rpcAddress() {
+		t.Errorf("CoordinatorLocal should pick the local node, got %s", address)
+	}
+
+	if address := node.coordinator(remote); address != first(remote) {
+		t.Errorf("CoordinatorLocal should fall back to %s, got %s", first(remote), address)
+	}
+
+	node.Coordinator = CoordinatorLeastLoaded
+	done := node.track(first(remote))
+
+	if address := node.coordinator(remote); address == first(remote) {
+		t.Errorf("CoordinatorLeastLoaded should avoid busy %s", address)
+	}
+
+	done()
+
+	if address := node.coordinator(remote); address != first(remote) {
+		t.Errorf("CoordinatorLeastLoaded should pick the first idle node %s, got %s", first(remote), address)
+	}
+
+	node.Coordinator = CoordinatorRandom
+	picked := map[string]bool{}
+
+	for i := 0; i < 100; i++ {
+		picked[node.coordinator(remote)] = true
+	}
+
+	if len(picked) != 2 {
+		t.Errorf("CoordinatorRandom should pick every replica, got %v", picked)
+	}
+}
+
+func TestCoordinatorFirstStandsIn(t *testing.T) {
+	node, _ := newLocalCluster(3)
+	node.ReplicationLevel = 2
+	node.Ring.Fail("b:3001")
+	key := ""
+
+	for i := 0; key == ""; i++ {
+		nodes, _ := node.Ring.FindN(fmt.Sprint(i), node.ReplicationLevel)
+
+		if nodes[0].Address == node.rpcAddress() && nodes[0].HintFor == "b:3001" {
+			key = fmt.Sprint(i)
+		}
+	}
+
+	if err := node.PutContext(context.Background(), key, "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := node.Hints.Get("b:3001", key); !ok {
+		t.Error("Coordinator standing in for b should queue a hint for it")
+	}
+
+	if _, ok := node.Data.Get(key); ok {
+		t.Error("Coordinator standing in for b should not store the value as its own")
+	}
+}
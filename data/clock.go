@@ -0,0 +1,88 @@
+package data
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Dot identifies a single write event. It is the counter a coordinating
+// node assigned to the write along with that node's address.
+type Dot struct {
+	Node    string
+	Counter uint64
+}
+
+// IsZero returns true if the dot was never assigned by a coordinator.
+// This is the case for values created locally with New.
+func (d Dot) IsZero() bool {
+	return d.Node == "" && d.Counter == 0
+}
+
+// String returns a string in the format node:counter.
+func (d Dot) String() string {
+	return fmt.Sprintf("%s:%d", d.Node, d.Counter)
+}
+
+// VectorClock maps node addresses to the latest counter seen from
+// that node.
+type VectorClock map[string]uint64
+
+// Copy returns a new VectorClock with the same entries.
+func (v VectorClock) Copy() VectorClock {
+	out := VectorClock{}
+
+	for node, counter := range v {
+		out[node] = counter
+	}
+
+	return out
+}
+
+// Merge sets every entry to the maximum of the current and the
+// other clock's counter.
+func (v VectorClock) Merge(other VectorClock) {
+	for node, counter := range other {
+		if counter > v[node] {
+			v[node] = counter
+		}
+	}
+}
+
+// Add includes the dot in the clock.
+func (v VectorClock) Add(dot Dot) {
+	if !dot.IsZero() && dot.Counter > v[dot.Node] {
+		v[dot.Node] = dot.Counter
+	}
+}
+
+// Contains returns true if the clock has seen the write identified
+// by dot.
+func (v VectorClock) Contains(dot Dot) bool {
+	return !dot.IsZero() && v[dot.Node] >= dot.Counter
+}
+
+// Descends returns true if every entry in other is less than or equal to
+// the same entry in the clock.
+func (v VectorClock) Descends(other VectorClock) bool {
+	for node, counter := range other {
+		if v[node] < counter {
+			return false
+		}
+	}
+
+	return true
+}
+
+// String returns a sorted, comma separated list of node:counter pairs.
+func (v VectorClock) String() string {
+	entries := []string{}
+
+	for node, counter := range v {
+		entries = append(entries, Dot{node, counter}.String())
+	}
+
+	sort.Strings(entries)
+
+	return "{" + strings.Join(entries, ", ") + "}"
+}
@@ -3,16 +3,40 @@
 package data
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"sort"
 	"time"
 )
 
 // Data is used internally to store key/value pairs.
-// A timestamp of when it was created is assigned to resolve data conflicts.
+//
+// Every write is identified by a Dot assigned by its coordinator and carries
+// the Clock of the versions it was based on. Together they form a dotted
+// version vector: a value supersedes another if its Clock contains the
+// other's Dot. Values that don't supersede each other are concurrent and are
+// kept as Siblings.
+//
+// A timestamp of when it was created is kept to order siblings and to resolve
+// values that were never versioned by a coordinator.
 type Data struct {
 	Key       string
 	Value     interface{}
 	Timestamp time.Time
+
+	// Clock is the causal context the value was written with.
+	Clock VectorClock
+
+	// Dot identifies the write that created this value.
+	Dot Dot
+
+	// Siblings are the concurrent versions of the key. Siblings never have
+	// siblings of their own.
+	Siblings []*Data
+
+	// Deleted marks the value as a tombstone. Tombstones are versioned like
+	// any other value so deletes replicate and supersede older writes.
+	Deleted bool
 }
 
 // IsLater takes another Data item and compares their timestamps.
@@ -22,13 +46,248 @@ func (d *Data) IsLater(other *Data) bool {
 	return d.Timestamp.After(other.Timestamp)
 }
 
+// Version returns the full version vector of this value, i.e. its Clock
+// including its own Dot.
+func (d *Data) Version() VectorClock {
+	version := d.Clock.Copy()
+	version.Add(d.Dot)
+	return version
+}
+
+// Supersedes returns true if d is causally newer than other and other can
+// be discarded. Both values are compared as single versions; siblings are
+// ignored.
+func (d *Data) Supersedes(other *Data) bool {
+	if d.Dot == other.Dot {
+		if !other.Clock.Descends(d.Clock) {
+			return d.Clock.Descends(other.Clock)
+		}
+
+		if !d.Clock.Descends(other.Clock) {
+			return false
+		}
+
+		return d.IsLater(other)
+	}
+
+	if other.Dot.IsZero() {
+		return true
+	}
+
+	return d.Clock.Contains(other.Dot)
+}
+
+// same returns true if both values are copies of the same version.
+func (d *Data) same(other *Data) bool {
+	return d.Dot == other.Dot &&
+		d.Clock.Descends(other.Clock) &&
+		other.Clock.Descends(d.Clock) &&
+		d.Timestamp.Equal(other.Timestamp)
+}
+
+// Versions returns the value and all its siblings as a flat list.
+func (d *Data) Versions() []*Data {
+	head := *d
+	head.Siblings = nil
+
+	return append([]*Data{&head}, d.Siblings...)
+}
+
+// Live returns the versions that aren't tombstones.
+func (d *Data) Live() []*Data {
+	live := []*Data{}
+
+	for _, version := range d.Versions() {
+		if !version.Deleted {
+			live = append(live, version)
+		}
+	}
+
+	return live
+}
+
+// IsDeleted returns true if every version of the value is a tombstone.
+func (d *Data) IsDeleted() bool {
+	return len(d.Live()) == 0
+}
+
+// Context returns a clock that contains every version of the value. Writes
+// made with this context supersede all the current siblings.
+func (d *Data) Context() VectorClock {
+	context := VectorClock{}
+
+	for _, version := range d.Versions() {
+		context.Merge(version.Version())
+	}
+
+	return context
+}
+
+// Descends returns true if every version of other is either present in d or
+// superseded by one of its versions. In this case merging other into d would
+// not change it.
+func (d *Data) Descends(other *Data) bool {
+	versions := d.Versions()
+
+	for _, theirs := range other.Versions() {
+		found := false
+
+		for _, ours := range versions {
+			if ours.same(theirs) || ours.Supersedes(theirs) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Reconcile returns a new value that contains the versions of d and other
+// that aren't superseded by any other version.
+func (d *Data) Reconcile(other *Data) *Data {
+	return Join(append(d.Versions(), other.Versions()...))
+}
+
 // String returns a string in the format key/value.
 func (d *Data) String() string {
+	if d.Deleted {
+		return fmt.Sprintf("%s/<deleted>", d.Key)
+	}
+
 	return fmt.Sprintf("%s/%v", d.Key, d.Value)
 }
 
+// Join drops every version that's superseded by another and returns the
+// remaining ones as a single value. The newest version by Timestamp becomes
+// the returned value and the rest become its siblings.
+// Returns nil if versions is empty.
+func Join(versions []*Data) *Data {
+	live := []*Data{}
+
+	for i, version := range versions {
+		obsolete := false
+
+		for j, other := range versions {
+			if i == j {
+				continue
+			}
+
+			// Keep only the first copy of identical versions.
+			if other.same(version) {
+				if j < i {
+					obsolete = true
+					break
+				}
+				continue
+			}
+
+			if other.Supersedes(version) {
+				obsolete = true
+				break
+			}
+		}
+
+		if !obsolete {
+			value := *version
+			value.Siblings = nil
+			live = append(live, &value)
+		}
+	}
+
+	if len(live) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(live, func(i, j int) bool {
+		if !live[i].Timestamp.Equal(live[j].Timestamp) {
+			return live[i].IsLater(live[j])
+		}
+
+		return live[i].Dot.String() < live[j].Dot.String()
+	})
+
+	head := live[0]
+
+	if len(live) > 1 {
+		head.Siblings = live[1:]
+	}
+
+	return head
+}
+
 // New creates a Data struct with the key/value provided and the current
-// as its Timestamp.
+// as its Timestamp. The value is unversioned until a coordinator assigns
+// it a Dot.
 func New(key string, value interface{}) *Data {
-	return &Data{key, value, time.Now()}
+	return &Data{
+		Key:       key,
+		Value:     value,
+		Timestamp: time.Now(),
+		Clock:     VectorClock{},
+	}
+}
+
+// Resolve returns a single version with the provided value that supersedes
+// all of the versions. If every version is a tombstone the resolved value
+// is also a tombstone.
+//
+// The resolved version reuses the greatest Dot of the versions rather than
+// creating a new one. This means every node that resolves the same versions
+// produces an identical value, so replicas converge without creating new
+// conflicts.
+func Resolve(versions []*Data, value interface{}) *Data {
+	resolved := &Data{
+		Key:     versions[0].Key,
+		Value:   value,
+		Clock:   VectorClock{},
+		Deleted: true,
+	}
+
+	for _, version := range versions {
+		resolved.Deleted = resolved.Deleted && version.Deleted
+		resolved.Clock.Merge(version.Version())
+
+		if version.IsLater(resolved) {
+			resolved.Timestamp = version.Timestamp
+		}
+
+		if resolved.Dot.Node < version.Dot.Node ||
+			(resolved.Dot.Node == version.Dot.Node && resolved.Dot.Counter < version.Dot.Counter) {
+			resolved.Dot = version.Dot
+		}
+	}
+
+	return resolved
+}
+
+// NewTombstone creates a Data struct that marks the key as deleted.
+func NewTombstone(key string) *Data {
+	d := New(key, nil)
+	d.Deleted = true
+	return d
+}
+
+// Digest returns a hash that identifies the set of versions in the value.
+// Replicas that have the same versions of a key have the same digest.
+func (d *Data) Digest() []byte {
+	versions := []string{}
+
+	for _, version := range d.Versions() {
+		versions = append(versions, fmt.Sprintf("%s %s %t %d", version.Dot, version.Clock, version.Deleted, version.Timestamp.UnixNano()))
+	}
+
+	sort.Strings(versions)
+
+	hash := sha256.New()
+
+	for _, version := range versions {
+		hash.Write([]byte(version))
+	}
+
+	return hash.Sum(nil)
 }
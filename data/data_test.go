@@ -0,0 +1,98 @@
+package data
+
+import "testing"
+
+func versioned(value string, node string, counter uint64, clock VectorClock) *Data {
+	d := New("foo", value)
+	d.Dot = Dot{node, counter}
+	d.Clock = clock
+	return d
+}
+
+func TestClockDescends(t *testing.T) {
+	a := VectorClock{"n1": 2, "n2": 1}
+	b := VectorClock{"n1": 1}
+
+	if !a.Descends(b) {
+		t.Errorf("%s should descend %s", a, b)
+	}
+
+	if b.Descends(a) {
+		t.Errorf("%s should not descend %s", b, a)
+	}
+
+	if !a.Descends(VectorClock{}) {
+		t.Error("Every clock should descend an empty clock")
+	}
+}
+
+func TestDataSupersedes(t *testing.T) {
+	first := versioned("a", "n1", 1, VectorClock{})
+	second := versioned("b", "n1", 2, first.Version())
+
+	if !second.Supersedes(first) {
+		t.Error("Value written with the first's context should supersede it")
+	}
+
+	if first.Supersedes(second) {
+		t.Error("Older value should not supersede a newer one")
+	}
+
+	if !first.Supersedes(New("foo", "unversioned")) {
+		t.Error("Versioned values should supersede unversioned ones")
+	}
+}
+
+func TestDataReconcileKeepsConcurrentValues(t *testing.T) {
+	base := versioned("a", "n1", 1, VectorClock{})
+	left := versioned("b", "n1", 2, base.Version())
+	right := versioned("c", "n2", 1, base.Version())
+
+	merged := base.Reconcile(left).Reconcile(right)
+
+	if len(merged.Versions()) != 2 {
+		t.Fatalf("Should keep two siblings, but kept %d", len(merged.Versions()))
+	}
+
+	if merged.Value != "c" {
+		t.Errorf("Newest sibling should be first, but was %s", merged.Value)
+	}
+
+	if !merged.Descends(left) || !merged.Descends(right) || !merged.Descends(base) {
+		t.Error("Merged value should descend every input")
+	}
+
+	resolved := versioned("d", "n1", 3, merged.Context())
+	merged = merged.Reconcile(resolved)
+
+	if len(merged.Versions()) != 1 || merged.Value != "d" {
+		t.Errorf("Write with merged context should replace siblings: %v", merged.Versions())
+	}
+}
+
+func TestDataReconcileDeduplicates(t *testing.T) {
+	value := versioned("a", "n1", 1, VectorClock{})
+	duplicate := *value
+
+	merged := value.Reconcile(&duplicate)
+
+	if len(merged.Versions()) != 1 {
+		t.Errorf("Copies of the same version should be merged: %v", merged.Versions())
+	}
+}
+
+func TestResolveIsDeterministic(t *testing.T) {
+	left := versioned("b", "n1", 2, VectorClock{"n1": 1})
+	right := versioned("c", "n2", 1, VectorClock{"n1": 1})
+
+	a := Resolve([]*Data{left, right}, "bc")
+	b := Resolve([]*Data{right, left}, "bc")
+
+	if !a.same(b) {
+		t.Errorf("Resolving the same versions should be identical: %s %s", a.Version(), b.Version())
+	}
+
+	if !a.Supersedes(left) || !a.Supersedes(right) {
+		t.Error("Resolved value should supersede every version")
+	}
+}
@@ -0,0 +1,250 @@
+package toystore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rlayte/toystore/data"
+	"github.com/rlayte/toystore/ring"
+)
+
+const (
+	// DefaultRemovalTimeout is used if Config.RemovalTimeout isn't set.
+	DefaultRemovalTimeout = time.Hour * 24
+
+	// DefaultRemovalInterval is the time between scans for members that
+	// have been gone longer than the removal timeout.
+	DefaultRemovalInterval = time.Minute
+)
+
+// Departures keeps track of members that have left the cluster. Members
+// that rejoin are revived, and members that have been gone for longer than
+// Timeout are treated as permanent departures: they're removed from the
+// ring and their ranges are re-replicated to restore ReplicationLevel.
+type Departures struct {
+	ScanInterval time.Duration
+	Timeout      time.Duration
+
+	store  *Toystore
+	failed map[string]time.Time
+	lock   *sync.Mutex
+
+	stop chan bool
+	done chan bool
+}
+
+// scan periodically removes members that have been gone too long.
+// It returns once Stop is called.
+func (d *Departures) scan() {
+	defer close(d.done)
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-time.After(d.ScanInterval):
+			for _, address := range d.Expired() {
+				if err := d.Remove(address); err != nil {
+					d.store.log.Printf("Re-replicating %s's ranges failed: %s", address, err)
+				}
+			}
+		}
+	}
+}
+
+// Start runs the scan process in the background until Stop is called.
+func (d *Departures) Start() {
+	go d.scan()
+}
+
+// Stop ends the scan process and waits for it to return.
+func (d *Departures) Stop() {
+	close(d.stop)
+	<-d.done
+}
+
+// Fail records that the member has left the cluster. It's kept in the ring
+// as failed until it rejoins or Timeout passes.
+func (d *Departures) Fail(address string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, ok := d.failed[address]; !ok {
+		d.failed[address] = time.Now()
+	}
+}
+
+// Revive forgets that the member left the cluster. It returns true if the
+// member had been marked as failed.
+func (d *Departures) Revive(address string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	_, ok := d.failed[address]
+	delete(d.failed, address)
+
+	return ok
+}
+
+// Expired returns every member that has been gone for longer than Timeout.
+func (d *Departures) Expired() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	expired := []string{}
+
+	for address, since := range d.failed {
+		if time.Since(since) > d.Timeout {
+			expired = append(expired, address)
+		}
+	}
+
+	return expired
+}
+
+// Remove permanently removes the member from the ring and re-replicates
+// its ranges.
+// For every local key the departed member was a replica of, the first of
+// the key's remaining replicas streams it to the nodes that have joined the
+// key's preference list in its place. If the departed member is the local
+// node it streams every key itself. Hints held for the departed member are
+// sent to the key's new replicas, and queued as hints for them if they
+// can't be reached.
+// Returns a TransferError if any of the keys couldn't be sent. They stay
+// queued and are retried in the background.
+func (d *Departures) Remove(address string) error {
+	return d.remove(address, true)
+}
+
+// Forget removes a member that has already streamed its ranges to their
+// new owners from the ring. Hints held for it are sent to the key's new
+// replicas.
+func (d *Departures) Forget(address string) error {
+	return d.remove(address, false)
+}
+
+// remove removes the member from the ring and sends its hints, and if
+// replicate is set its keys, to their new replicas.
+func (d *Departures) remove(address string, replicate bool) error {
+	t := d.store
+
+	d.lock.Lock()
+	delete(d.failed, address)
+	d.lock.Unlock()
+
+	before := map[string]ring.PreferenceList{}
+
+	if replicate {
+		before = t.preferenceLists()
+	}
+
+	t.log.Printf("Removing %s from the ring", address)
+	t.Ring.Remove(address)
+
+	moved := t.moves(before, address)
+	hints := map[string][]*data.Data{}
+
+	for _, value := range t.Hints.Remove(address) {
+		after, _ := t.Ring.FindN(value.Key, t.ReplicationLevel)
+
+		for _, node := range after {
+			if node.Address == t.rpcAddress() {
+				t.Merge(value)
+			} else {
+				hints[node.Address] = append(hints[node.Address], value)
+			}
+		}
+	}
+
+	var err error
+
+	for target, values := range hints {
+		if sendErr := d.send(target, values); sendErr != nil && err == nil {
+			err = sendErr
+		}
+	}
+
+	for target, keys := range moved {
+		t.log.Printf("Re-replicating %d items to %s", len(keys), target)
+		t.Streams.Add(target, keys)
+
+		if sendErr := t.Streams.Send(target); sendErr != nil && err == nil {
+			err = sendErr
+		}
+	}
+
+	return err
+}
+
+// send transfers hints to their new replica in chunks of the stream chunk
+// size. If a chunk isn't accepted it and the rest of the values are queued
+// as hints for the replica, and a TransferError is returned.
+func (d *Departures) send(target string, values []*data.Data) error {
+	t := d.store
+
+	for start := 0; start < len(values); start += t.Streams.ChunkSize {
+		end := start + t.Streams.ChunkSize
+
+		if end > len(values) {
+			end = len(values)
+		}
+
+		if !t.transferrer.Transfer(target, values[start:end]) {
+			for _, value := range values[start:] {
+				t.Hints.Put(value, target)
+			}
+
+			return &TransferError{target, len(values) - start}
+		}
+	}
+
+	return nil
+}
+
+// replicates returns true if address is one of the key's own replicas
+// rather than a stand-in.
+func replicates(nodes ring.PreferenceList, address string) bool {
+	for _, node := range nodes {
+		if node.Address == address && node.HintFor == "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sender returns the first of the key's own replicas other than the
+// departed node, which is responsible for re-replicating it.
+func sender(nodes ring.PreferenceList, departed string) string {
+	for _, node := range nodes {
+		if node.HintFor == "" && node.Address != departed {
+			return node.Address
+		}
+	}
+
+	return ""
+}
+
+// NewDepartures returns a new instance using the RemovalTimeout defined in
+// config.
+func NewDepartures(config Config, store *Toystore) *Departures {
+	d := &Departures{
+		ScanInterval: DefaultRemovalInterval,
+		Timeout:      config.RemovalTimeout,
+		store:        store,
+		failed:       map[string]time.Time{},
+		lock:         &sync.Mutex{},
+		stop:         make(chan bool),
+		done:         make(chan bool),
+	}
+
+	if d.Timeout == 0 {
+		d.Timeout = DefaultRemovalTimeout
+	}
+
+	if d.Timeout < d.ScanInterval {
+		d.ScanInterval = d.Timeout
+	}
+
+	return d
+}
@@ -0,0 +1,175 @@
+package toystore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rlayte/toystore/data"
+	"github.com/rlayte/toystore/ring"
+)
+
+func TestDeparturesExpire(t *testing.T) {
+	d := NewDepartures(Config{RemovalTimeout: time.Millisecond * 10}, newLocalNode())
+	d.Fail("b:3001")
+	d.Fail("c:3001")
+
+	if !d.Revive("c:3001") {
+		t.Error("c should have been failed")
+	}
+
+	if len(d.Expired()) != 0 {
+		t.Error("Nothing should expire before the timeout")
+	}
+
+	time.Sleep(time.Millisecond * 20)
+
+	if fmt.Sprint(d.Expired()) != "[b:3001]" {
+		t.Errorf("Only b should expire, but %v did", d.Expired())
+	}
+}
+
+func TestDeparturesRemoveReReplicates(t *testing.T) {
+	node, _ := newLocalCluster(4)
+	node.ReplicationLevel = 2
+	transferrer := &FakeTransferrer{sent: map[string][]*data.Data{}, status: true}
+	node.transferrer = transferrer
+	node.Streams = NewStreams(Config{}, node, transferrer)
+	node.Hints = NewHintedHandoff(Config{}, node.Metrics, transferrer)
+	node.Hints.Put(data.New("hinted", "value"), "b:3001")
+	d := NewDepartures(Config{RemovalTimeout: time.Hour}, node)
+
+	before := map[string]ring.PreferenceList{}
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprint(i)
+		node.Merge(data.New(key, "value"))
+	}
+
+	node.Ring.Fail("b:3001")
+
+	for _, key := range node.Data.Keys() {
+		before[key], _ = node.Ring.FindN(key, node.ReplicationLevel)
+	}
+
+	d.Fail("b:3001")
+	d.Remove("b:3001")
+
+	if len(d.Expired()) != 0 || node.Hints.Depth("b:3001") != 0 {
+		t.Error("Removed members should be forgotten")
+	}
+
+	sent := func(address string, key string) bool {
+		for _, value := range transferrer.sent[address] {
+			if value.Key == key {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	checked := 0
+
+	for key, nodes := range before {
+		if sender(nodes, "b:3001") != node.rpcAddress() {
+			continue
+		}
+
+		replaced := false
+
+		for _, replica := range nodes {
+			replaced = replaced || replica.HintFor == "b:3001"
+		}
+
+		if !replaced {
+			continue
+		}
+
+		after, _ := node.Ring.FindN(key, node.ReplicationLevel)
+
+		for _, replica := range after {
+			if replica.Address == "b:3001" || replica.HintFor != "" {
+				t.Errorf("b should be removed from %s's preference list: %v", key, after)
+			}
+
+			if !replicates(nodes, replica.Address) && !sent(replica.Address, key) {
+				t.Errorf("%s should have been sent to %s", key, replica.Address)
+			}
+
+			checked++
+		}
+	}
+
+	if checked == 0 {
+		t.Error("Some keys should have been re-replicated by the node")
+	}
+
+	after, _ := node.Ring.FindN("hinted", node.ReplicationLevel)
+
+	for _, replica := range after {
+		_, local := node.Data.Get("hinted")
+
+		if !sent(replica.Address, "hinted") && !(replica.Address == node.rpcAddress() && local) {
+			t.Errorf("Hint for b should have been sent to %s", replica.Address)
+		}
+	}
+}
+
+func TestDeparturesRemoveQueuesUnsentHints(t *testing.T) {
+	node, _ := newLocalCluster(4)
+	node.ReplicationLevel = 2
+	transferrer := &FlakyTransferrer{sent: map[string][]*data.Data{}, failAt: 2}
+	node.transferrer = transferrer
+	node.Streams = NewStreams(Config{}, node, transferrer)
+	node.Streams.ChunkSize = 2
+	node.Hints = NewHintedHandoff(Config{}, node.Metrics, transferrer)
+	d := NewDepartures(Config{RemovalTimeout: time.Hour}, node)
+
+	for i := 0; i < 20; i++ {
+		node.Hints.Put(data.New(fmt.Sprint(i), "value"), "b:3001")
+	}
+
+	if err := d.Remove("b:3001"); err == nil {
+		t.Error("Remove should fail when hints can't be sent")
+	}
+
+	sent := 0
+
+	for _, values := range transferrer.sent {
+		sent += len(values)
+	}
+
+	if sent > 2 {
+		t.Errorf("Hints should be sent in chunks, but %d were accepted in one", sent)
+	}
+
+	queued := 0
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprint(i)
+		after, _ := node.Ring.FindN(key, node.ReplicationLevel)
+
+		for _, replica := range after {
+			_, local := node.Data.Get(key)
+			_, hinted := node.Hints.Get(replica.Address, key)
+			delivered := false
+
+			for _, value := range transferrer.sent[replica.Address] {
+				delivered = delivered || value.Key == key
+			}
+
+			if hinted {
+				queued++
+			}
+
+			if !delivered && !hinted && !(replica.Address == node.rpcAddress() && local) {
+				t.Errorf("Hint for %s should have been sent or queued for %s", key, replica.Address)
+			}
+		}
+	}
+
+	if queued == 0 {
+		t.Error("Hints that couldn't be sent should be queued for their new replicas")
+	}
+}
@@ -0,0 +1,136 @@
+package toystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ConfigError is returned by New when the Config is invalid.
+type ConfigError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("toystore: invalid config %s: %s", e.Field, e.Reason)
+}
+
+// OptionsError is returned when the Options passed to a request are
+// invalid.
+type OptionsError struct {
+	Field  string
+	Reason string
+}
+
+func (e *OptionsError) Error() string {
+	return fmt.Sprintf("toystore: invalid options %s: %s", e.Field, e.Reason)
+}
+
+// ListenError is returned when the RPC server can't listen on its address,
+// e.g. because the port is already in use.
+type ListenError struct {
+	Address string
+	Err     error
+}
+
+func (e *ListenError) Error() string {
+	return fmt.Sprintf("toystore: failed to listen on %s: %s", e.Address, e.Err)
+}
+
+func (e *ListenError) Unwrap() error {
+	return e.Err
+}
+
+// GossipError is returned when the gossip protocol can't be started or the
+// node can't join the cluster. Op is either "create" or "join".
+type GossipError struct {
+	Op      string
+	Address string
+	Err     error
+}
+
+func (e *GossipError) Error() string {
+	return fmt.Sprintf("toystore: failed to %s gossip cluster at %s: %s", e.Op, e.Address, e.Err)
+}
+
+func (e *GossipError) Unwrap() error {
+	return e.Err
+}
+
+// ErrNotFound is returned when a key doesn't exist or has been deleted.
+var ErrNotFound = errors.New("toystore: key not found")
+
+// ErrTimeout is returned when a request's context deadline passes before
+// it completes.
+var ErrTimeout = errors.New("toystore: request timed out")
+
+// ErrQuorumNotMet is matched by every QuorumError using errors.Is.
+var ErrQuorumNotMet = errors.New("toystore: quorum not met")
+
+// ErrUnreachable is matched by every UnreachableError using errors.Is.
+var ErrUnreachable = errors.New("toystore: node unreachable")
+
+// QuorumError is returned when fewer than R nodes respond to a read or
+// fewer than W nodes acknowledge a write.
+type QuorumError struct {
+	Op       string
+	Acks     int
+	Required int
+}
+
+func (e *QuorumError) Error() string {
+	return fmt.Sprintf("%s: %s received %d of %d required acks", ErrQuorumNotMet, e.Op, e.Acks, e.Required)
+}
+
+func (e *QuorumError) Is(target error) bool {
+	return target == ErrQuorumNotMet
+}
+
+// UnreachableError is returned when a node, e.g. a key's coordinator,
+// can't be contacted.
+type UnreachableError struct {
+	Address string
+	Err     error
+}
+
+func (e *UnreachableError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", ErrUnreachable, e.Address, e.Err)
+}
+
+func (e *UnreachableError) Is(target error) bool {
+	return target == ErrUnreachable
+}
+
+func (e *UnreachableError) Unwrap() error {
+	return e.Err
+}
+
+// ErrBootstrapping is returned by reads from a node that is still
+// streaming its ranges from other nodes.
+var ErrBootstrapping = errors.New("toystore: node is bootstrapping")
+
+// ErrDecommissioning is returned by writes to a node that is streaming its
+// ranges to other nodes before it leaves the cluster.
+var ErrDecommissioning = errors.New("toystore: node is decommissioning")
+
+// TransferError is returned when items can't be sent to the node that
+// should own them.
+type TransferError struct {
+	Address string
+	Items   int
+}
+
+func (e *TransferError) Error() string {
+	return fmt.Sprintf("toystore: failed to transfer %d items to %s", e.Items, e.Address)
+}
+
+// contextError converts a finished context's error into the package's
+// errors. Expired deadlines become ErrTimeout.
+func contextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+
+	return ctx.Err()
+}
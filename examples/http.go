@@ -11,10 +11,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/rlayte/toystore"
@@ -22,8 +24,9 @@ import (
 )
 
 const (
-	SeedAddress string = "127.0.0.2"
-	RpcPort     int    = 3001
+	SeedAddress    string        = "127.0.0.2"
+	RpcPort        int           = 3001
+	RequestTimeout time.Duration = time.Second * 2
 )
 
 type Api struct {
@@ -40,12 +43,17 @@ func (a *Api) Address() string {
 
 func (a *Api) Get(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	key := params.ByName("key")
-	value, ok := a.store.Get(key)
+	ctx, cancel := context.WithTimeout(r.Context(), RequestTimeout)
+	defer cancel()
 
-	if !ok {
-		w.Header().Set("Status", "404")
+	value, err := a.store.GetContext(ctx, key)
+
+	if err == toystore.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprint(w, "Not found\n")
-		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Failed: %s\n", err)
 	} else {
 		fmt.Fprint(w, value)
 	}
@@ -54,8 +62,23 @@ func (a *Api) Get(w http.ResponseWriter, r *http.Request, params httprouter.Para
 func (a *Api) Put(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	key := r.FormValue("key")
 	value := r.FormValue("value")
+	ctx, cancel := context.WithTimeout(r.Context(), RequestTimeout)
+	defer cancel()
+
+	err := a.store.PutContext(ctx, key, value)
+
+	if err == nil {
+		fmt.Fprint(w, "Success\n")
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Failed: %s\n", err)
+	}
+}
+
+func (a *Api) Delete(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	key := params.ByName("key")
 
-	ok := a.store.Put(key, value)
+	ok := a.store.Delete(key)
 
 	if ok {
 		fmt.Fprint(w, "Success\n")
@@ -71,6 +94,7 @@ func (a *Api) Serve() {
 	router.GET("/", a.Meta)
 	router.GET("/:key", a.Get)
 	router.POST("/", a.Put)
+	router.DELETE("/:key", a.Delete)
 
 	log.Println("Running server on", a.Address())
 	log.Fatal(http.ListenAndServe(a.Address(), router))
@@ -97,7 +121,12 @@ func main() {
 		config.SeedAddress = SeedAddress
 	}
 
-	store := toystore.New(config)
+	store, err := toystore.New(config)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	api := Api{store}
 
 	api.Serve()
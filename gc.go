@@ -0,0 +1,98 @@
+package toystore
+
+import "time"
+
+const (
+	// DefaultTombstoneGracePeriod is used if Config.TombstoneGracePeriod
+	// isn't set.
+	DefaultTombstoneGracePeriod = time.Hour * 24
+
+	// DefaultGCInterval is used if Config.GCInterval isn't set.
+	DefaultGCInterval = time.Minute
+)
+
+// GarbageCollector periodically scans the node's data and purges tombstones
+// that are older than the grace period.
+type GarbageCollector struct {
+	ScanInterval time.Duration
+	GracePeriod  time.Duration
+
+	store *Toystore
+
+	stop chan bool
+	done chan bool
+}
+
+// scan periodically collects expired tombstones.
+// It returns once Stop is called.
+func (g *GarbageCollector) scan() {
+	defer close(g.done)
+
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-time.After(g.ScanInterval):
+			g.Collect()
+		}
+	}
+}
+
+// Start runs the scan process in the background until Stop is called.
+func (g *GarbageCollector) Start() {
+	go g.scan()
+}
+
+// Stop ends the scan process and waits for it to return.
+func (g *GarbageCollector) Stop() {
+	close(g.stop)
+	<-g.done
+}
+
+// Collect removes every tombstone older than GracePeriod and returns the
+// number of keys removed.
+func (g *GarbageCollector) Collect() int {
+	t := g.store
+	removed := 0
+
+	for _, key := range t.Data.Keys() {
+		t.lock.Lock()
+		value, ok := t.Data.Get(key)
+
+		if ok && value.IsDeleted() && time.Since(value.Timestamp) > g.GracePeriod {
+			t.Data.Delete(key)
+			t.changed(key, nil)
+			removed++
+		}
+
+		t.lock.Unlock()
+	}
+
+	if removed > 0 {
+		t.log.Printf("Purged %d tombstones", removed)
+	}
+
+	return removed
+}
+
+// NewGarbageCollector returns a new instance using the GCInterval and
+// TombstoneGracePeriod defined in config.
+func NewGarbageCollector(config Config, store *Toystore) *GarbageCollector {
+	g := &GarbageCollector{
+		ScanInterval: config.GCInterval,
+		GracePeriod:  config.TombstoneGracePeriod,
+		store:        store,
+		stop:         make(chan bool),
+		done:         make(chan bool),
+	}
+
+	if g.ScanInterval == 0 {
+		g.ScanInterval = DefaultGCInterval
+	}
+
+	if g.GracePeriod == 0 {
+		g.GracePeriod = DefaultTombstoneGracePeriod
+	}
+
+	return g
+}
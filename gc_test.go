@@ -0,0 +1,56 @@
+package toystore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeleteHidesKey(t *testing.T) {
+	node := newLocalNode()
+	node.Put("foo", "bar")
+
+	if !node.Delete("foo") {
+		t.Fatal("Delete should succeed")
+	}
+
+	if value, ok := node.Get("foo"); ok {
+		t.Errorf("Deleted key should not be found, but was %v", value)
+	}
+
+	if _, ok := node.Data.Get("foo"); !ok {
+		t.Error("Tombstone should be stored until it's collected")
+	}
+
+	node.Put("foo", "baz")
+
+	if value, _ := node.Get("foo"); value != "baz" {
+		t.Errorf("Writes after a delete should be found, but was %v", value)
+	}
+}
+
+func TestGarbageCollectorPurgesExpiredTombstones(t *testing.T) {
+	node := newLocalNode()
+	gc := &GarbageCollector{GracePeriod: time.Millisecond * 10, store: node}
+
+	node.Put("live", "value")
+	node.Put("dead", "value")
+	node.Delete("dead")
+
+	if removed := gc.Collect(); removed != 0 {
+		t.Errorf("Tombstones within the grace period should be kept, removed %d", removed)
+	}
+
+	time.Sleep(gc.GracePeriod * 2)
+
+	if removed := gc.Collect(); removed != 1 {
+		t.Errorf("Should have removed one tombstone, removed %d", removed)
+	}
+
+	if _, ok := node.Data.Get("dead"); ok {
+		t.Error("Expired tombstone should be purged")
+	}
+
+	if _, ok := node.Data.Get("live"); !ok {
+		t.Error("Live keys should not be purged")
+	}
+}
@@ -1,56 +1,591 @@
 package toystore
 
 import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/rlayte/toystore/data"
+	"github.com/rlayte/toystore/store"
+	"github.com/rlayte/toystore/store/memory"
 )
 
+const (
+	// DefaultHandoffInterval is used if Config.HandoffInterval isn't set.
+	DefaultHandoffInterval = time.Second * 10
+
+	// DefaultMaxHints is used if Config.MaxHints isn't set.
+	DefaultMaxHints = 10000
+
+	// DefaultMaxHintAge is used if Config.MaxHintAge isn't set.
+	DefaultMaxHintAge = time.Hour * 3
+
+	// Time to wait before the first retry of hints a node didn't accept.
+	// It doubles after every failed attempt up to the scan interval.
+	hintRetryBackoff = time.Millisecond * 100
+
+	// Prefix of the hint records kept in the node's Store if
+	// Config.HintStore isn't set. Data can't be stored under keys that
+	// start with it.
+	hintNamespace = "\x00hints/"
+)
+
+// hint is a value waiting to be delivered to another node.
+type hint struct {
+	// Key of the hint's record in the hint store.
+	id     string
+	value  *data.Data
+	queued time.Time
+}
+
+// queue holds the hints for one node, oldest first, and tracks whether
+// they can be delivered.
+type queue struct {
+	hints []*hint
+
+	// Hints by the key of their value. Each key has at most one hint.
+	keys map[string]*hint
+
+	// Set while the node is known to be down.
+	down bool
+
+	// Number of failed deliveries since the last success, and when the next
+	// delivery can be attempted.
+	failures int
+	retry    time.Time
+}
+
 // HintedHandoff keeps track of data that should be stored on other
-// nodes. It periodically scans this data and attempts to transfer
-// it to the correct node. It then removes any data that is transferred.
+// nodes. It attempts to transfer it to the correct node once it's alive
+// and then removes any data that is transferred.
+//
+// Hints are kept in a queue per node and written to a Store so they survive
+// restarts. Only the newest version of each key is kept, so a key written
+// many times while a node is down is only replayed once. Each queue holds
+// at most MaxHints values and values older than MaxAge are dropped, so a
+// node that's down for a long time can't exhaust memory; anti-entropy
+// repairs anything that's dropped once it returns.
+//
+// Delivery is driven by membership events: nodes marked down with Fail are
+// skipped until Alive is called when they rejoin, which delivers their
+// hints straight away. Hints are sent in chunks of ChunkSize, and only the
+// chunks that aren't accepted are kept; those are retried with exponential
+// backoff up to ScanInterval.
+// HintedHandoff is safe for concurrent use.
 type HintedHandoff struct {
 	ScanInterval time.Duration
+	MaxHints     int
+	MaxAge       time.Duration
+
+	// Number of hints sent to a node in each transfer.
+	ChunkSize int
+
+	store   store.Store
+	queues  map[string]*queue
+	next    uint64
+	metrics *Metrics
+	client  Transferrer
+	lock    *sync.Mutex
+
+	// Held while hints are being delivered so they're only sent once.
+	flushing *sync.Mutex
+
+	wake chan bool
+	stop chan bool
+	done chan bool
+}
+
+// hintID returns the key of a hint's record in the hint store. Sequence
+// numbers are zero padded so records sort in the order they were queued.
+func hintID(target string, seq uint64) string {
+	return fmt.Sprintf("%s/%020d", target, seq)
+}
+
+// parseHintID returns the target and sequence number of a hint record key.
+func parseHintID(id string) (target string, seq uint64, ok bool) {
+	i := strings.LastIndex(id, "/")
+
+	if i < 0 {
+		return "", 0, false
+	}
+
+	seq, err := strconv.ParseUint(id[i+1:], 10, 64)
 
-	data   map[string][]*data.Data
-	client Transferrer
+	if err != nil {
+		return "", 0, false
+	}
+
+	return id[:i], seq, true
+}
+
+// load restores the queues from the hint store.
+func (h *HintedHandoff) load() {
+	ids := h.store.Keys()
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		target, seq, ok := parseHintID(id)
+
+		if !ok {
+			continue
+		}
+
+		record, ok := h.store.Get(id)
+
+		if !ok {
+			continue
+		}
+
+		value, ok := record.Value.(data.Data)
+
+		if !ok {
+			continue
+		}
+
+		if seq >= h.next {
+			h.next = seq + 1
+		}
+
+		restored := &hint{id, &value, record.Timestamp}
+
+		// Save the reconciled value if the key was already queued.
+		if !h.add(target, restored) {
+			h.save(restored)
+		}
+	}
 }
 
-// scan periodically attempts to transfer hinted data to its correct
-// location. If it removes any data it no longer needs.
+// scan delivers hints whenever a node comes back or a retry is due.
+// It returns once Stop is called.
 func (h *HintedHandoff) scan() {
+	defer close(h.done)
+
 	for {
-		for node, hints := range h.data {
-			ok := h.client.Transfer(node, hints)
+		wait := h.deliver()
+
+		select {
+		case <-h.stop:
+			return
+		case <-h.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// deliver sends hints to every node that isn't down and isn't backing
+// off, and returns the time until the next retry is due.
+func (h *HintedHandoff) deliver() time.Duration {
+	h.flushing.Lock()
+	defer h.flushing.Unlock()
+
+	h.expire()
+
+	for _, target := range h.Targets() {
+		if h.ready(target) {
+			h.send(target)
+		}
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	wait := h.ScanInterval
+
+	for _, q := range h.queues {
+		if len(q.hints) > 0 && !q.down && time.Until(q.retry) < wait {
+			wait = time.Until(q.retry)
+		}
+	}
+
+	if wait < 0 {
+		wait = 0
+	}
+
+	return wait
+}
+
+// Flush attempts to transfer all hinted data to its correct location, even
+// if the node is down or backing off, and returns the hints that couldn't
+// be delivered, keyed by their location.
+// Expired hints are dropped first.
+func (h *HintedHandoff) Flush() map[string][]*data.Data {
+	h.flushing.Lock()
+	defer h.flushing.Unlock()
+
+	h.expire()
+
+	for _, target := range h.Targets() {
+		h.send(target)
+	}
+
+	remaining := map[string][]*data.Data{}
+
+	for _, target := range h.Targets() {
+		for _, hint := range h.pending(target) {
+			remaining[target] = append(remaining[target], hint.value)
+		}
+	}
+
+	return remaining
+}
+
+// send transfers the location's hints in chunks of ChunkSize and removes
+// each chunk once it's accepted. If a chunk isn't accepted the rest are
+// kept and the next attempt is backed off. It returns true if every hint
+// was delivered.
+func (h *HintedHandoff) send(target string) bool {
+	pending := h.pending(target)
+
+	for start := 0; start < len(pending); start += h.ChunkSize {
+		end := start + h.ChunkSize
+
+		if end > len(pending) {
+			end = len(pending)
+		}
+
+		chunk := pending[start:end]
+		values := make([]*data.Data, len(chunk))
+
+		for i, hint := range chunk {
+			values[i] = hint.value
+		}
+
+		if !h.client.Transfer(target, values) {
+			h.backoff(target)
+			return false
+		}
+
+		h.delivered(target, chunk)
+	}
+
+	return true
+}
+
+// backoff delays the next delivery to the location after a failure.
+func (h *HintedHandoff) backoff(target string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	q := h.queue(target)
+	backoff := h.ScanInterval
+
+	if q.failures < 32 && hintRetryBackoff<<q.failures < backoff {
+		backoff = hintRetryBackoff << q.failures
+	}
+
+	q.failures++
+	q.retry = time.Now().Add(backoff)
+}
+
+// delivered removes hints the location has accepted from its queue.
+func (h *HintedHandoff) delivered(target string, sent []*hint) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	q := h.queue(target)
+	q.failures = 0
+	q.retry = time.Time{}
+
+	delivered := map[*hint]bool{}
+
+	for _, hint := range sent {
+		delivered[hint] = true
+	}
 
-			if ok {
-				delete(h.data, node)
-			}
+	// Keys written again while they were being sent have been replaced by
+	// a new hint and are kept.
+	kept := []*hint{}
+
+	for _, hint := range q.hints {
+		if delivered[hint] {
+			h.store.Delete(hint.id)
+			delete(q.keys, hint.value.Key)
+		} else {
+			kept = append(kept, hint)
+		}
+	}
+
+	h.metrics.HintsQueued.Add(-int64(len(q.hints) - len(kept)))
+	q.hints = kept
+}
+
+// ready returns true if the location isn't down and isn't backing off.
+func (h *HintedHandoff) ready(target string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	q := h.queue(target)
+
+	return !q.down && !time.Now().Before(q.retry)
+}
+
+// Start runs the scan process in the background until Stop is called.
+func (h *HintedHandoff) Start() {
+	go h.scan()
+}
+
+// Stop ends the scan process and waits for it to return.
+func (h *HintedHandoff) Stop() {
+	close(h.stop)
+	<-h.done
+}
+
+// Alive records that the location has joined or rejoined the cluster and
+// delivers its hints without waiting for the next scan.
+func (h *HintedHandoff) Alive(target string) {
+	h.lock.Lock()
+	q := h.queue(target)
+	q.down = false
+	q.failures = 0
+	q.retry = time.Time{}
+	h.lock.Unlock()
+
+	select {
+	case h.wake <- true:
+	default:
+	}
+}
+
+// Fail records that the location has left the cluster. Its hints are kept
+// but not sent until Alive is called.
+func (h *HintedHandoff) Fail(target string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.queue(target).down = true
+}
+
+// Put adds a new value for the hinted location. If the location already
+// has a hint for the key it's replaced by the newest version. If the
+// location's queue is full its oldest value is dropped.
+func (h *HintedHandoff) Put(value *data.Data, target string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	next := &hint{hintID(target, h.next), value, time.Now()}
+	h.next++
+
+	if h.add(target, next) {
+		h.metrics.HintsQueued.Add(1)
+	}
+
+	h.save(next)
+	q := h.queue(target)
+
+	if len(q.hints) > h.MaxHints {
+		h.drop(target, len(q.hints)-h.MaxHints)
+	}
+}
+
+// add queues the hint, reconciling it with any hint already queued for its
+// key. It returns true if the key wasn't already queued. The lock must be
+// held.
+func (h *HintedHandoff) add(target string, next *hint) bool {
+	q := h.queue(target)
+	current, ok := q.keys[next.value.Key]
+
+	if ok {
+		next.value = current.value.Reconcile(next.value)
+		h.store.Delete(current.id)
+		h.remove(target, current)
+	}
+
+	q.hints = append(q.hints, next)
+	q.keys[next.value.Key] = next
+
+	return !ok
+}
+
+// save writes the hint to the hint store.
+func (h *HintedHandoff) save(saved *hint) {
+	h.store.Put(&data.Data{Key: saved.id, Value: *saved.value, Timestamp: saved.queued})
+}
+
+// remove takes the hint out of the location's queue. The lock must be
+// held.
+func (h *HintedHandoff) remove(target string, removed *hint) {
+	q := h.queue(target)
+
+	for i, hint := range q.hints {
+		if hint == removed {
+			q.hints = append(q.hints[:i:i], q.hints[i+1:]...)
+			break
+		}
+	}
+
+	delete(q.keys, removed.value.Key)
+}
+
+// Remove deletes and returns every hint for the location.
+func (h *HintedHandoff) Remove(target string) []*data.Data {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	values := []*data.Data{}
+
+	for _, hint := range h.queue(target).hints {
+		h.store.Delete(hint.id)
+		values = append(values, hint.value)
+	}
+
+	h.metrics.HintsQueued.Add(-int64(len(values)))
+	delete(h.queues, target)
+
+	return values
+}
+
+// Get returns the hint held for the key on behalf of the location.
+func (h *HintedHandoff) Get(target string, key string) (*data.Data, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if q, ok := h.queues[target]; ok {
+		if hint, ok := q.keys[key]; ok {
+			return hint.value, true
+		}
+	}
+
+	return nil, false
+}
+
+// Depth returns the number of hints queued for the location.
+func (h *HintedHandoff) Depth(target string) int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return len(h.queue(target).hints)
+}
+
+// Targets returns every location that has hints queued, in sorted order.
+func (h *HintedHandoff) Targets() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	targets := make([]string, 0, len(h.queues))
+
+	for target, q := range h.queues {
+		if len(q.hints) > 0 {
+			targets = append(targets, target)
+		}
+	}
+
+	sort.Strings(targets)
+
+	return targets
+}
+
+// queue returns the location's queue, creating it if it doesn't exist.
+// The lock must be held.
+func (h *HintedHandoff) queue(target string) *queue {
+	q, ok := h.queues[target]
+
+	if !ok {
+		q = &queue{hints: []*hint{}, keys: map[string]*hint{}}
+		h.queues[target] = q
+	}
+
+	return q
+}
+
+// pending returns a copy of the location's hints.
+func (h *HintedHandoff) pending(target string) []*hint {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return append([]*hint{}, h.queue(target).hints...)
+}
+
+// expire drops every hint that has been queued for longer than MaxAge.
+func (h *HintedHandoff) expire() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for target, q := range h.queues {
+		expired := 0
+
+		for expired < len(q.hints) && time.Since(q.hints[expired].queued) > h.MaxAge {
+			expired++
 		}
 
-		time.Sleep(h.ScanInterval)
+		h.drop(target, expired)
 	}
 }
 
-// Put adds a new value for the hinted location.
-func (h *HintedHandoff) Put(value *data.Data, hint string) {
-	if _, ok := h.data[hint]; !ok {
-		h.data[hint] = []*data.Data{}
+// drop discards the oldest n hints for the location. The lock must be
+// held.
+func (h *HintedHandoff) drop(target string, n int) {
+	q := h.queue(target)
+
+	for _, hint := range q.hints[:n] {
+		h.store.Delete(hint.id)
+		delete(q.keys, hint.value.Key)
 	}
 
-	h.data[hint] = append(h.data[hint], value)
+	q.hints = q.hints[n:]
+	h.metrics.HintsQueued.Add(-int64(n))
+	h.metrics.HintsDropped.Add(int64(n))
 }
 
-// NewHintedHandoff returns a new instance and starts the scan process
-// using the HandoffInterval defined in config.
-func NewHintedHandoff(config Config, client Transferrer) *HintedHandoff {
+// NewHintedHandoff returns a new instance using the HandoffInterval,
+// MaxHints, MaxHintAge and TransferChunkSize defined in config. Hints left
+// in config.HintStore by a previous run are queued again. If it isn't set
+// hints are only kept in memory.
+func NewHintedHandoff(config Config, metrics *Metrics, client Transferrer) *HintedHandoff {
 	h := &HintedHandoff{
 		ScanInterval: config.HandoffInterval,
-		data:         map[string][]*data.Data{},
+		MaxHints:     config.MaxHints,
+		MaxAge:       config.MaxHintAge,
+		ChunkSize:    config.TransferChunkSize,
+		store:        config.HintStore,
+		queues:       map[string]*queue{},
+		metrics:      metrics,
 		client:       client,
+		lock:         &sync.Mutex{},
+		flushing:     &sync.Mutex{},
+		wake:         make(chan bool, 1),
+		stop:         make(chan bool),
+		done:         make(chan bool),
 	}
 
-	go h.scan()
+	if h.ScanInterval == 0 {
+		h.ScanInterval = DefaultHandoffInterval
+	}
+
+	if h.MaxHints == 0 {
+		h.MaxHints = DefaultMaxHints
+	}
+
+	if h.MaxAge == 0 {
+		h.MaxAge = DefaultMaxHintAge
+	}
+
+	if h.ChunkSize == 0 {
+		h.ChunkSize = DefaultTransferChunkSize
+	}
+
+	if h.store == nil {
+		h.store = memory.New()
+	}
+
+	h.load()
+	h.metrics.HintsQueued.Add(int64(h.count()))
 
 	return h
 }
+
+// count returns the number of hints queued for every location.
+func (h *HintedHandoff) count() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	total := 0
+
+	for _, q := range h.queues {
+		total += len(q.hints)
+	}
+
+	return total
+}
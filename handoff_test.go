@@ -1,18 +1,26 @@
 package toystore
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/rlayte/toystore/data"
+	"github.com/rlayte/toystore/store/memory"
+	"github.com/rlayte/toystore/store/namespace"
 )
 
 type FakeTransferrer struct {
 	sent   map[string][]*data.Data
 	status bool
+	lock   sync.Mutex
 }
 
 func (f *FakeTransferrer) Transfer(address string, hints []*data.Data) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
 	if _, ok := f.sent[address]; !ok {
 		f.sent[address] = []*data.Data{}
 	}
@@ -23,8 +31,9 @@ func (f *FakeTransferrer) Transfer(address string, hints []*data.Data) bool {
 
 func TestHandoffPut(t *testing.T) {
 	config := Config{HandoffInterval: time.Millisecond * 10}
-	client := &FakeTransferrer{map[string][]*data.Data{}, false}
-	h := NewHintedHandoff(config, client)
+	client := &FakeTransferrer{sent: map[string][]*data.Data{}, status: false}
+	h := NewHintedHandoff(config, &Metrics{}, client)
+	h.Start()
 
 	h.Put(data.New("foo", "bar"), "n1")
 	h.Put(data.New("food", "bar"), "n1")
@@ -37,12 +46,246 @@ func TestHandoffPut(t *testing.T) {
 	time.Sleep(config.HandoffInterval * 2)
 	client.status = true
 	time.Sleep(config.HandoffInterval * 2)
+	h.Stop()
 
-	if len(client.sent["n1"]) != 3 {
-		t.Errorf("Should have sent one item, but sent %d", len(client.sent["n1"]))
+	if len(client.sent["n1"]) != 2 {
+		t.Errorf("Should have sent two items, but sent %d", len(client.sent["n1"]))
 	}
 
 	if len(client.sent["n2"]) != 2 {
 		t.Errorf("Should have sent one item, but sent %d", len(client.sent["n1"]))
 	}
 }
+
+func TestHandoffBounded(t *testing.T) {
+	node := newLocalNode()
+	h := NewHintedHandoff(Config{}, node.Metrics, &FlakyTransferrer{sent: map[string][]*data.Data{}, failAt: 1})
+	h.MaxHints = 3
+
+	for i := 0; i < 5; i++ {
+		h.Put(data.New(fmt.Sprint(i), "value"), "n1")
+	}
+
+	h.Put(data.New("a", "value"), "n2")
+
+	if h.Depth("n1") != 3 || h.Depth("n2") != 1 {
+		t.Errorf("Expected queues of 3 and 1, got %d and %d", h.Depth("n1"), h.Depth("n2"))
+	}
+
+	if queued, dropped := node.Metrics.HintsQueued.Load(), node.Metrics.HintsDropped.Load(); queued != 4 || dropped != 2 {
+		t.Errorf("Expected 4 queued and 2 dropped, got %d and %d", queued, dropped)
+	}
+
+	if remaining := h.Flush(); remaining["n1"][0].Key != "2" {
+		t.Errorf("The oldest hints should be dropped, %v remain", remaining["n1"])
+	}
+
+	h.MaxAge = time.Millisecond
+	time.Sleep(time.Millisecond * 5)
+
+	if remaining := h.Flush(); len(remaining) != 0 {
+		t.Errorf("Expired hints should be dropped, %v remain", remaining)
+	}
+
+	if queued, dropped := node.Metrics.HintsQueued.Load(), node.Metrics.HintsDropped.Load(); queued != 0 || dropped != 6 {
+		t.Errorf("Expected 0 queued and 6 dropped, got %d and %d", queued, dropped)
+	}
+}
+
+func TestHandoffRestart(t *testing.T) {
+	client := &FlakyTransferrer{sent: map[string][]*data.Data{}, failAt: 1}
+	backend := memory.New()
+	config := Config{HandoffInterval: time.Hour, HintStore: namespace.New(backend, hintNamespace)}
+	h := NewHintedHandoff(config, &Metrics{}, client)
+	h.Start()
+
+	h.Put(data.New("foo", "bar"), "n1")
+	h.Put(data.New("food", "baz"), "n1")
+	h.Put(data.New("food", "bar"), "n2")
+	h.Stop()
+
+	if keys := namespace.Exclude(backend, hintNamespace).Keys(); len(keys) != 0 {
+		t.Errorf("Hints should be hidden from the node's data, got %v", keys)
+	}
+
+	// Only the backend survives a restart.
+	client.failAt = 0
+	config.HintStore = namespace.New(backend, hintNamespace)
+	restarted := NewHintedHandoff(config, &Metrics{}, client)
+	restarted.Start()
+	defer restarted.Stop()
+
+	if restarted.Depth("n1") != 2 || restarted.Depth("n2") != 1 {
+		t.Fatalf("Hints should be restored, got %d and %d", restarted.Depth("n1"), restarted.Depth("n2"))
+	}
+
+	restarted.Put(data.New("fool", "qux"), "n1")
+	restarted.Flush()
+
+	values := []string{}
+
+	for _, value := range client.sent["n1"] {
+		values = append(values, fmt.Sprint(value.Value))
+	}
+
+	if fmt.Sprint(values) != "[bar baz qux]" {
+		t.Errorf("Hints should be sent in the order they were queued, got %v", values)
+	}
+
+	if keys := backend.Keys(); len(keys) != 0 {
+		t.Errorf("Delivered hints should be deleted, %v remain", keys)
+	}
+}
+
+func TestHandoffConcurrent(t *testing.T) {
+	node := newLocalNode()
+	h := NewHintedHandoff(Config{}, node.Metrics, &FakeTransferrer{sent: map[string][]*data.Data{}, status: true})
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				h.Put(data.New(fmt.Sprint(j), "value"), fmt.Sprintf("n%d", i))
+			}
+		}(i)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 10; j++ {
+				h.Flush()
+			}
+		}()
+	}
+
+	wg.Wait()
+	h.Flush()
+
+	if queued := node.Metrics.HintsQueued.Load(); queued != 0 {
+		t.Errorf("Every hint should be delivered, %d queued", queued)
+	}
+}
+
+func TestHandoffCoalesce(t *testing.T) {
+	node := newLocalNode()
+	client := &FakeTransferrer{sent: map[string][]*data.Data{}, status: true}
+	h := NewHintedHandoff(Config{}, node.Metrics, client)
+
+	h.Put(data.New("foo", "bar"), "n1")
+	h.Put(data.New("food", "bar"), "n1")
+	time.Sleep(time.Millisecond)
+	h.Put(data.New("foo", "baz"), "n1")
+
+	if h.Depth("n1") != 2 || node.Metrics.HintsQueued.Load() != 2 {
+		t.Errorf("Hints should be kept once per key, got %d", h.Depth("n1"))
+	}
+
+	h.Flush()
+	values := []string{}
+
+	for _, value := range client.sent["n1"] {
+		values = append(values, value.String())
+	}
+
+	if fmt.Sprint(values) != "[food/bar foo/baz]" {
+		t.Errorf("Only the newest version should be sent, got %v", values)
+	}
+
+	if keys := h.store.Keys(); len(keys) != 0 {
+		t.Errorf("Delivered hints should be deleted, %v remain", keys)
+	}
+}
+
+func TestHandoffWaitsForMember(t *testing.T) {
+	node := newLocalNode()
+	client := &FlakyTransferrer{sent: map[string][]*data.Data{}}
+	h := NewHintedHandoff(Config{}, node.Metrics, client)
+	h.ScanInterval = time.Hour
+
+	h.Fail("n1")
+	h.Put(data.New("foo", "bar"), "n1")
+	h.Put(data.New("foo", "bar"), "n2")
+	h.deliver()
+
+	if client.calls != 1 || len(client.sent["n2"]) != 1 {
+		t.Errorf("Hints should only be sent to n2, sent %v", client.sent)
+	}
+
+	h.Alive("n1")
+
+	select {
+	case <-h.wake:
+	default:
+		t.Error("Alive should wake the scan")
+	}
+
+	h.deliver()
+
+	if len(client.sent["n1"]) != 1 {
+		t.Error("Hints should be sent once n1 is alive")
+	}
+}
+
+func TestHandoffBackoff(t *testing.T) {
+	node := newLocalNode()
+	client := &FlakyTransferrer{sent: map[string][]*data.Data{}, failAt: 1, recoverAt: 3}
+	h := NewHintedHandoff(Config{}, node.Metrics, client)
+	h.ScanInterval = time.Hour
+
+	h.Put(data.New("foo", "bar"), "n1")
+
+	if wait := h.deliver(); wait <= 0 || wait > hintRetryBackoff {
+		t.Errorf("First retry should wait %s, got %s", hintRetryBackoff, wait)
+	}
+
+	h.deliver()
+
+	if client.calls != 1 {
+		t.Errorf("Hints shouldn't be sent again before the backoff, sent %d times", client.calls)
+	}
+
+	time.Sleep(hintRetryBackoff)
+
+	if wait := h.deliver(); wait <= hintRetryBackoff || wait > hintRetryBackoff*2 {
+		t.Errorf("Backoff should double to %s, got %s", hintRetryBackoff*2, wait)
+	}
+
+	h.Alive("n1")
+	h.deliver()
+
+	if client.calls != 3 || h.Depth("n1") != 0 {
+		t.Errorf("Alive should reset the backoff, sent %d times", client.calls)
+	}
+}
+
+func TestHandoffSendsChunks(t *testing.T) {
+	client := &FlakyTransferrer{sent: map[string][]*data.Data{}, failAt: 2}
+	h := NewHintedHandoff(Config{}, &Metrics{}, client)
+	h.ChunkSize = 2
+
+	for i := 0; i < 5; i++ {
+		h.Put(data.New(fmt.Sprint(i), "value"), "n1")
+	}
+
+	if remaining := h.Flush(); len(remaining["n1"]) != 3 {
+		t.Errorf("Only the chunk that failed and the rest should be kept, got %d", len(remaining["n1"]))
+	}
+
+	if len(client.sent["n1"]) != 2 {
+		t.Errorf("The first chunk should have been delivered, got %d hints", len(client.sent["n1"]))
+	}
+
+	client.failAt = 0
+
+	if remaining := h.Flush(); len(remaining) != 0 {
+		t.Errorf("Every hint should be delivered, %v remain", remaining)
+	}
+
+	if client.calls != 4 {
+		t.Errorf("Hints should be sent in chunks of 2, got %d transfers", client.calls)
+	}
+}
@@ -1,6 +1,7 @@
 package toystore
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/hashicorp/memberlist"
@@ -10,9 +11,41 @@ import (
 type Member interface {
 	Name() string
 	Address() string
+	Weight() int
+	Decommissioned() bool
 	Meta() []byte
 }
 
+// NodeMeta is the metadata each node gossips about itself.
+type NodeMeta struct {
+	// RPC address of the node.
+	Address string
+
+	// Capacity of the node relative to the others. Nodes own ranges of the
+	// ring in proportion to their weight.
+	Weight int
+
+	// True once the node has streamed its ranges to other nodes and should
+	// be removed from the ring.
+	Decommissioned bool `json:",omitempty"`
+}
+
+// decodeMeta parses gossiped metadata. Nodes that only gossip their RPC
+// address are given a weight of 1.
+func decodeMeta(meta []byte) NodeMeta {
+	decoded := NodeMeta{}
+
+	if err := json.Unmarshal(meta, &decoded); err != nil {
+		return NodeMeta{Address: string(meta), Weight: 1}
+	}
+
+	if decoded.Weight < 1 {
+		decoded.Weight = 1
+	}
+
+	return decoded
+}
+
 // MemberlistNode is an implementation of Member that wraps hashicorp's
 // memberlist.Node
 type MemberlistNode struct {
@@ -24,9 +57,19 @@ func (m *MemberlistNode) Name() string {
 	return m.node.Name
 }
 
-// Address returns node.Meta as a string
+// Address returns the RPC address stored in node.Meta
 func (m *MemberlistNode) Address() string {
-	return string(m.node.Meta)
+	return decodeMeta(m.node.Meta).Address
+}
+
+// Weight returns the capacity weight stored in node.Meta
+func (m *MemberlistNode) Weight() int {
+	return decodeMeta(m.node.Meta).Weight
+}
+
+// Decommissioned returns the decommissioned flag stored in node.Meta
+func (m *MemberlistNode) Decommissioned() bool {
+	return decodeMeta(m.node.Meta).Decommissioned
 }
 
 // Meta returns the raw value of node.Meta
@@ -36,10 +79,12 @@ func (m *MemberlistNode) Meta() []byte {
 
 // Members repsents the current nodes in the cluster.
 type Members interface {
-	Setup(t *Toystore)
-	Join(seed string)
+	Setup(t *Toystore) error
+	Join(seed string) error
 	Members() []Member
 	Len() int
+	Update() error
+	Leave() error
 }
 
 // Memberlist is an implementation of Members using hashicorp's memberlist.
@@ -48,11 +93,17 @@ type Memberlist struct {
 }
 
 // Setup creates a new instance of memberlist, assigns it to list, and
-// sets the local nodes meta data as the rpc address.
-func (m *Memberlist) Setup(t *Toystore) {
+// sets the local nodes meta data to its rpc address and weight.
+// Returns a GossipError if the gossip server can't be started.
+func (m *Memberlist) Setup(t *Toystore) error {
 	memberConfig := memberlist.DefaultLocalConfig()
 	memberConfig.BindAddr = t.Host
 	memberConfig.Name = t.Host
+	// Use memberlist's default port unless one is configured.
+	if t.GossipPort != 0 {
+		memberConfig.BindPort = t.GossipPort
+		memberConfig.AdvertisePort = t.GossipPort
+	}
 	// Set IndirectChecks to 0 so we see a local view of membership.
 	// I.e. we don't care about nodes hidden by partitions.
 	memberConfig.IndirectChecks = 0
@@ -60,31 +111,51 @@ func (m *Memberlist) Setup(t *Toystore) {
 	memberConfig.GossipInterval = time.Millisecond * 20
 	// Sets delegate to handle membership change events.
 	memberConfig.Events = &MemberlistEvents{t}
+	// Sets delegate to gossip the local node's meta data.
+	memberConfig.Delegate = &MemberlistDelegate{t}
 
 	list, err := memberlist.Create(memberConfig)
+
 	if err != nil {
-		panic(err)
+		return &GossipError{"create", t.Host, err}
 	}
+
 	m.list = list
-	n := m.list.LocalNode()
-	n.Meta = []byte(t.rpcAddress())
 
-	if err != nil {
-		panic("Failed to create memberlist: " + err.Error())
-	}
+	return nil
 }
 
 // Join attempts to join the cluster that the seed node is a member of.
-func (m *Memberlist) Join(seed string) {
+// Returns a GossipError if the seed can't be reached.
+func (m *Memberlist) Join(seed string) error {
 	if seed == "" {
-		return
+		return nil
 	}
 
 	_, err := m.list.Join([]string{seed})
 
 	if err != nil {
-		panic("Failed to join cluster: " + err.Error())
+		return &GossipError{"join", seed, err}
 	}
+
+	return nil
+}
+
+// Update broadcasts the local node's current meta data to the cluster.
+func (m *Memberlist) Update() error {
+	return m.list.UpdateNode(time.Second)
+}
+
+// Leave broadcasts that the local node is leaving the cluster and shuts
+// down the gossip server.
+func (m *Memberlist) Leave() error {
+	err := m.list.Leave(time.Second)
+
+	if shutdownErr := m.list.Shutdown(); err == nil {
+		err = shutdownErr
+	}
+
+	return err
 }
 
 // Members return a list of all current members in the cluster.
@@ -105,11 +176,20 @@ func (m *Memberlist) Len() int {
 
 // NewMemberlist returns a new instance of Memberlist, sets up the gossip
 // server, and attempts to join the seed node's cluster.
-func NewMemberlist(t *Toystore, seed string) *Memberlist {
+// If it can't join the cluster the gossip server is shut down.
+func NewMemberlist(t *Toystore, seed string) (*Memberlist, error) {
 	list := &Memberlist{}
-	list.Setup(t)
-	list.Join(seed)
-	return list
+
+	if err := list.Setup(t); err != nil {
+		return nil, err
+	}
+
+	if err := list.Join(seed); err != nil {
+		list.list.Shutdown()
+		return nil, err
+	}
+
+	return list, nil
 }
 
 // MemberlistEvents implements memberlist.Events which acts as a delegate for
@@ -144,3 +224,41 @@ func (m *MemberlistEvents) NotifyUpdate(node *memberlist.Node) {
 		m.toystore.AddMember(member)
 	}
 }
+
+// MemberlistDelegate implements memberlist.Delegate to gossip the local
+// node's meta data. Toystore doesn't use any other gossip messages.
+type MemberlistDelegate struct {
+	toystore *Toystore
+}
+
+// NodeMeta returns the local node's RPC address, weight and whether it has
+// been decommissioned.
+func (m *MemberlistDelegate) NodeMeta(limit int) []byte {
+	meta, _ := json.Marshal(NodeMeta{
+		Address:        m.toystore.rpcAddress(),
+		Weight:         m.toystore.weight(),
+		Decommissioned: m.toystore.isDecommissioned(),
+	})
+
+	if len(meta) > limit {
+		return []byte(m.toystore.rpcAddress())
+	}
+
+	return meta
+}
+
+// NotifyMsg is unused.
+func (m *MemberlistDelegate) NotifyMsg([]byte) {}
+
+// GetBroadcasts is unused.
+func (m *MemberlistDelegate) GetBroadcasts(overhead, limit int) [][]byte {
+	return nil
+}
+
+// LocalState is unused.
+func (m *MemberlistDelegate) LocalState(join bool) []byte {
+	return nil
+}
+
+// MergeRemoteState is unused.
+func (m *MemberlistDelegate) MergeRemoteState(buf []byte, join bool) {}
@@ -0,0 +1,82 @@
+package toystore
+
+import (
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/rlayte/toystore/data"
+)
+
+func TestMemberlistNodeMeta(t *testing.T) {
+	node := newLocalNode()
+	node.capacity = 3
+	node.decommissioned = true
+	delegate := &MemberlistDelegate{node}
+	member := &MemberlistNode{&memberlist.Node{Meta: delegate.NodeMeta(512)}}
+
+	if member.Address() != node.rpcAddress() || member.Weight() != 3 {
+		t.Errorf("Expected %s with weight 3, got %s with weight %d", node.rpcAddress(), member.Address(), member.Weight())
+	}
+
+	if !member.Decommissioned() {
+		t.Error("Member should be decommissioned")
+	}
+
+	legacy := &MemberlistNode{&memberlist.Node{Meta: []byte("127.0.0.2:3001")}}
+
+	if legacy.Address() != "127.0.0.2:3001" || legacy.Weight() != 1 || legacy.Decommissioned() {
+		t.Errorf("Address only meta should have weight 1, got %s with weight %d", legacy.Address(), legacy.Weight())
+	}
+}
+
+func TestSetWeightRebalances(t *testing.T) {
+	node := newLocalNode()
+	transferrer := &FakeTransferrer{sent: map[string][]*data.Data{}, status: true}
+	node.Streams = NewStreams(Config{}, node, transferrer)
+	node.Ring.SetWeight("127.0.0.2:3001", 100)
+
+	if err := node.SetWeight(0); err == nil {
+		t.Error("Weight must be at least 1")
+	}
+
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		node.Merge(data.New(key, "value"))
+	}
+
+	node.Ring.SetWeight(node.rpcAddress(), 8)
+	owned := map[string]bool{}
+
+	for _, key := range node.Data.Keys() {
+		owned[key] = node.Ring.Find(key) == node.rpcAddress()
+	}
+
+	if err := node.SetWeight(1); err != nil {
+		t.Fatal(err)
+	}
+
+	node.Streams.Flush()
+
+	if len(transferrer.sent) == 0 {
+		t.Fatal("Some keys should have moved")
+	}
+
+	for _, items := range transferrer.sent {
+		for _, item := range items {
+			if node.Ring.Find(item.Key) == node.rpcAddress() {
+				t.Errorf("%s is still owned by the node and shouldn't move", item.Key)
+			}
+		}
+	}
+
+	for _, key := range node.Data.Keys() {
+		moved := false
+
+		for _, item := range transferrer.sent[node.Ring.Find(key)] {
+			moved = moved || item.Key == key
+		}
+
+		if owned[key] && node.Ring.Find(key) != node.rpcAddress() && !moved {
+			t.Errorf("%s should have moved to %s", key, node.Ring.Find(key))
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Package merkle implements hash trees used to find the keys that differ
+// between two replicas without comparing every key.
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// Tree is a complete binary hash tree of fixed depth. Keys are assigned to
+// leaves by their hash, so trees of the same depth built over the same keys
+// always have the same shape and can be compared node by node.
+//
+// Each leaf is the XOR of the hashes of its key/digest pairs, so items can
+// be added in any order.
+type Tree struct {
+	Depth int
+
+	// Nodes are stored in level order. The root is Nodes[0] and the children
+	// of node i are 2i+1 and 2i+2.
+	Nodes [][]byte
+}
+
+// leaves returns the number of leaves in the tree.
+func (t *Tree) leaves() int {
+	return 1 << uint(t.Depth)
+}
+
+// firstLeaf returns the index of the first leaf in Nodes.
+func (t *Tree) firstLeaf() int {
+	return t.leaves() - 1
+}
+
+// Leaf returns the leaf the key is assigned to.
+func (t *Tree) Leaf(key string) int {
+	hash := sha256.Sum256([]byte(key))
+	return int(binary.BigEndian.Uint32(hash[:4]) % uint32(t.leaves()))
+}
+
+// Add includes the key and a digest of its value in the tree.
+// Build must be called after adding items.
+func (t *Tree) Add(key string, digest []byte) {
+	item := sha256.New()
+	item.Write([]byte(key))
+	item.Write(digest)
+	hash := item.Sum(nil)
+
+	leaf := t.Nodes[t.firstLeaf()+t.Leaf(key)]
+
+	for i := range leaf {
+		leaf[i] ^= hash[i]
+	}
+}
+
+// Remove takes a key and digest previously added out of the tree.
+// Build must be called after removing items.
+func (t *Tree) Remove(key string, digest []byte) {
+	// Adding the same item twice cancels it out.
+	t.Add(key, digest)
+}
+
+// Copy returns a deep copy of the tree.
+func (t *Tree) Copy() *Tree {
+	c := &Tree{Depth: t.Depth, Nodes: make([][]byte, len(t.Nodes))}
+
+	for i, node := range t.Nodes {
+		c.Nodes[i] = append([]byte{}, node...)
+	}
+
+	return c
+}
+
+// All returns every leaf in the tree.
+func (t *Tree) All() []int {
+	leaves := make([]int, t.leaves())
+
+	for i := range leaves {
+		leaves[i] = i
+	}
+
+	return leaves
+}
+
+// Build computes every internal node from the leaves.
+func (t *Tree) Build() {
+	for i := t.firstLeaf() - 1; i >= 0; i-- {
+		hash := sha256.New()
+		hash.Write(t.Nodes[2*i+1])
+		hash.Write(t.Nodes[2*i+2])
+		t.Nodes[i] = hash.Sum(nil)
+	}
+}
+
+// Root returns the hash of the whole tree.
+func (t *Tree) Root() []byte {
+	return t.Nodes[0]
+}
+
+// Diff returns the leaves that differ between the trees. It only descends
+// into subtrees whose hashes differ. Trees of different depths differ in
+// every leaf.
+func Diff(a, b *Tree) []int {
+	leaves := []int{}
+
+	if a.Depth != b.Depth || len(a.Nodes) != len(b.Nodes) {
+		return a.All()
+	}
+
+	var walk func(i int)
+	walk = func(i int) {
+		if bytes.Equal(a.Nodes[i], b.Nodes[i]) {
+			return
+		}
+
+		if i >= a.firstLeaf() {
+			leaves = append(leaves, i-a.firstLeaf())
+			return
+		}
+
+		walk(2*i + 1)
+		walk(2*i + 2)
+	}
+
+	walk(0)
+
+	return leaves
+}
+
+// New returns an empty tree with 2^depth leaves.
+func New(depth int) *Tree {
+	t := &Tree{Depth: depth}
+	t.Nodes = make([][]byte, 2*t.leaves()-1)
+
+	for i := range t.Nodes {
+		t.Nodes[i] = make([]byte, sha256.Size)
+	}
+
+	return t
+}
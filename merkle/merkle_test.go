@@ -0,0 +1,69 @@
+package merkle
+
+import (
+	"fmt"
+	"testing"
+)
+
+func build(items map[string]string) *Tree {
+	t := New(4)
+
+	for key, digest := range items {
+		t.Add(key, []byte(digest))
+	}
+
+	t.Build()
+	return t
+}
+
+func TestTreeEqual(t *testing.T) {
+	items := map[string]string{}
+
+	for i := 0; i < 100; i++ {
+		items[fmt.Sprintf("key-%d", i)] = fmt.Sprintf("value-%d", i)
+	}
+
+	a := build(items)
+	b := build(items)
+
+	if diff := Diff(a, b); len(diff) != 0 {
+		t.Errorf("Trees over the same items should be equal, but differ in %v", diff)
+	}
+}
+
+func TestTreeDiff(t *testing.T) {
+	a := build(map[string]string{"foo": "1", "bar": "1", "baz": "1"})
+	b := build(map[string]string{"foo": "2", "bar": "1", "baz": "1"})
+
+	diff := Diff(a, b)
+
+	if len(diff) != 1 || diff[0] != a.Leaf("foo") {
+		t.Errorf("Trees should only differ in foo's leaf %d, but differ in %v", a.Leaf("foo"), diff)
+	}
+
+	c := build(map[string]string{"bar": "1", "baz": "1"})
+	diff = Diff(a, c)
+
+	if len(diff) != 1 || diff[0] != a.Leaf("foo") {
+		t.Errorf("Missing keys should differ in their leaf, but differ in %v", diff)
+	}
+}
+
+func TestTreeRemove(t *testing.T) {
+	a := build(map[string]string{"foo": "1", "bar": "1"})
+	b := a.Copy()
+
+	b.Add("baz", []byte("1"))
+	b.Remove("foo", []byte("1"))
+	b.Build()
+
+	expected := build(map[string]string{"bar": "1", "baz": "1"})
+
+	if diff := Diff(b, expected); len(diff) != 0 {
+		t.Errorf("Removing an item should undo adding it, but differ in %v", diff)
+	}
+
+	if diff := Diff(a, build(map[string]string{"foo": "1", "bar": "1"})); len(diff) != 0 {
+		t.Errorf("Changing a copy should not change the original, but differ in %v", diff)
+	}
+}
@@ -0,0 +1,28 @@
+package toystore
+
+import "sync/atomic"
+
+// Metrics counts events on a node. Counters are safe to read and update
+// concurrently.
+type Metrics struct {
+	// Number of replicas that were sent a newer value after returning stale
+	// or missing data to a read.
+	ReadRepairs atomic.Int64
+
+	// Number of values received through anti-entropy that changed the
+	// node's data.
+	AntiEntropyMerges atomic.Int64
+
+	// Number of keys streamed to other nodes and acknowledged.
+	KeysTransferred atomic.Int64
+
+	// Number of chunks that weren't acknowledged and were sent again.
+	TransferRetries atomic.Int64
+
+	// Number of hints waiting to be delivered to other nodes.
+	HintsQueued atomic.Int64
+
+	// Number of hints discarded because their node's queue was full or
+	// they expired before it came back.
+	HintsDropped atomic.Int64
+}
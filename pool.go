@@ -0,0 +1,153 @@
+package toystore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDialTimeout is used if Config.DialTimeout isn't set.
+	DefaultDialTimeout = time.Second
+
+	// DefaultCallTimeout is used if Config.CallTimeout isn't set.
+	DefaultCallTimeout = time.Second * 5
+
+	// DefaultConnectionsPerPeer is used if Config.ConnectionsPerPeer isn't
+	// set.
+	DefaultConnectionsPerPeer = 2
+
+	// DefaultHealthCheckInterval is used if Config.HealthCheckInterval isn't
+	// set.
+	DefaultHealthCheckInterval = time.Second * 5
+
+	// Bounds for the delay between failed attempts to connect to a peer.
+	minDialBackoff = time.Millisecond * 100
+	maxDialBackoff = time.Second * 10
+)
+
+// errBackoff is returned when a peer recently refused connections and the
+// pool is waiting before dialing it again.
+var errBackoff = errors.New("waiting to reconnect")
+
+// peerPool keeps persistent connections to a single peer.
+// rpc.Client multiplexes concurrent calls, so a few connections are enough
+// to serve any number of requests.
+type peerPool struct {
+	address string
+	size    int
+	clients []*rpc.Client
+	next    int
+
+	// Reconnection state after a failed dial.
+	backoff time.Duration
+	retryAt time.Time
+
+	lock *sync.Mutex
+}
+
+// get returns a connection to the peer, dialing a new one if the pool
+// isn't full. Connections are handed out round-robin.
+func (p *peerPool) get(ctx context.Context, timeout time.Duration) (*rpc.Client, error) {
+	p.lock.Lock()
+
+	if len(p.clients) >= p.size || (len(p.clients) > 0 && time.Now().Before(p.retryAt)) {
+		client := p.clients[p.next%len(p.clients)]
+		p.next++
+		p.lock.Unlock()
+		return client, nil
+	}
+
+	if time.Now().Before(p.retryAt) {
+		p.lock.Unlock()
+		return nil, errBackoff
+	}
+
+	p.lock.Unlock()
+
+	client, err := dial(ctx, p.address, timeout)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err != nil {
+		p.backoff *= 2
+
+		if p.backoff < minDialBackoff {
+			p.backoff = minDialBackoff
+		}
+
+		if p.backoff > maxDialBackoff {
+			p.backoff = maxDialBackoff
+		}
+
+		p.retryAt = time.Now().Add(p.backoff)
+
+		if len(p.clients) > 0 {
+			return p.clients[0], nil
+		}
+
+		return nil, err
+	}
+
+	p.backoff = 0
+	p.retryAt = time.Time{}
+
+	// Another call may have filled the pool while this one was dialing.
+	if len(p.clients) >= p.size {
+		client.Close()
+		return p.clients[0], nil
+	}
+
+	p.clients = append(p.clients, client)
+
+	return client, nil
+}
+
+// remove discards a broken connection.
+func (p *peerPool) remove(client *rpc.Client) {
+	p.lock.Lock()
+
+	for i, c := range p.clients {
+		if c == client {
+			p.clients = append(p.clients[:i], p.clients[i+1:]...)
+			break
+		}
+	}
+
+	p.lock.Unlock()
+
+	client.Close()
+}
+
+// all returns a copy of the pool's current connections.
+func (p *peerPool) all() []*rpc.Client {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return append([]*rpc.Client{}, p.clients...)
+}
+
+// close closes every connection in the pool.
+func (p *peerPool) close() {
+	for _, client := range p.all() {
+		p.remove(client)
+	}
+}
+
+// dial attempts to connect to a specified RPC server.
+// If it can't connect within timeout, or before the context is done, it
+// aborts and returns the error.
+func dial(ctx context.Context, address string, timeout time.Duration) (*rpc.Client, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return rpc.NewClient(conn), nil
+}
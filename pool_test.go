@@ -0,0 +1,116 @@
+package toystore
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+// PingServer serves RpcHandler.Ping and counts accepted connections.
+type PingServer struct {
+	listener net.Listener
+	conns    []net.Conn
+	lock     *sync.Mutex
+}
+
+func newPingServer(t *testing.T) *PingServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &PingServer{listener: l, lock: &sync.Mutex{}}
+	rpcs := rpc.NewServer()
+	rpcs.RegisterName("RpcHandler", &RpcHandler{})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+
+			if err != nil {
+				return
+			}
+
+			s.lock.Lock()
+			s.conns = append(s.conns, conn)
+			s.lock.Unlock()
+
+			go rpcs.ServeConn(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *PingServer) accepted() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.conns)
+}
+
+// drop closes every connection from the server's side.
+func (s *PingServer) drop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func TestRpcClientReusesConnections(t *testing.T) {
+	server := newPingServer(t)
+	defer server.listener.Close()
+
+	client := NewRpcClient(Config{ConnectionsPerPeer: 1})
+	defer client.Close()
+
+	address := server.listener.Addr().String()
+
+	for i := 0; i < 10; i++ {
+		if err := client.call(context.Background(), address, "RpcHandler.Ping", &PingArgs{}, &PingReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if server.accepted() != 1 {
+		t.Errorf("Should reuse one connection, but opened %d", server.accepted())
+	}
+}
+
+func TestRpcClientReconnects(t *testing.T) {
+	server := newPingServer(t)
+	defer server.listener.Close()
+
+	client := NewRpcClient(Config{ConnectionsPerPeer: 1})
+	defer client.Close()
+
+	address := server.listener.Addr().String()
+	client.call(context.Background(), address, "RpcHandler.Ping", &PingArgs{}, &PingReply{})
+	server.drop()
+	time.Sleep(time.Millisecond * 10)
+
+	if err := client.call(context.Background(), address, "RpcHandler.Ping", &PingArgs{}, &PingReply{}); err != nil {
+		t.Errorf("Should reconnect after a broken connection, got %v", err)
+	}
+
+	if server.accepted() != 2 {
+		t.Errorf("Should have opened a new connection, but opened %d", server.accepted())
+	}
+}
+
+func TestRpcClientUnreachable(t *testing.T) {
+	client := NewRpcClient(Config{DialTimeout: time.Millisecond * 100})
+	defer client.Close()
+
+	err := client.call(context.Background(), "127.0.0.1:1", "RpcHandler.Ping", &PingArgs{}, &PingReply{})
+
+	if !errors.Is(err, ErrUnreachable) {
+		t.Errorf("Expected ErrUnreachable, got %v", err)
+	}
+}
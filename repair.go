@@ -0,0 +1,72 @@
+package toystore
+
+import (
+	"context"
+	"sync"
+)
+
+// ReadRepairMode controls how a coordinator updates replicas that return
+// stale data to a read.
+type ReadRepairMode int
+
+const (
+	// ReadRepairAsync repairs replicas in the background after the read
+	// returns. This is the default.
+	ReadRepairAsync ReadRepairMode = iota
+
+	// ReadRepairSync repairs the replicas that responded before the read
+	// returns. Replicas that respond later are repaired in the background.
+	ReadRepairSync
+
+	// ReadRepairOff disables read repair.
+	ReadRepairOff
+)
+
+// readRepair sends the coordinator's merged value of the key to every
+// replica whose response didn't already contain it. Nodes standing in for a
+// failed replica are sent it as a hint so it reaches the replica when it
+// returns.
+func (t *Toystore) readRepair(ctx context.Context, key string, responses []replicaResult) {
+	current, ok := t.Data.Get(key)
+
+	if !ok {
+		return
+	}
+
+	wg := &sync.WaitGroup{}
+
+	for _, response := range responses {
+		if response.address == t.rpcAddress() {
+			continue
+		}
+
+		if response.value != nil && response.value.Descends(current) {
+			continue
+		}
+
+		wg.Add(1)
+
+		go func(address string, hint string) {
+			defer wg.Done()
+
+			t.log.Printf("Repairing %s on %s", key, address)
+
+			var err error
+
+			if hint != "" {
+				err = t.client.HintPut(ctx, address, hint, current)
+			} else {
+				err = t.client.Put(ctx, address, current)
+			}
+
+			if err != nil {
+				t.log.Printf("Failed to repair %s on %s: %s", key, address, err)
+				return
+			}
+
+			t.Metrics.ReadRepairs.Add(1)
+		}(response.address, response.hint)
+	}
+
+	wg.Wait()
+}
@@ -0,0 +1,148 @@
+package toystore
+
+import (
+	"reflect"
+
+	"github.com/rlayte/toystore/data"
+)
+
+// Resolver reconciles the concurrent versions of a key into a single value.
+// It's called whenever a node detects that replicas have diverged. Resolve
+// must be deterministic so every node resolves the same versions to the
+// same value.
+type Resolver interface {
+	Resolve(key string, versions []*data.Data) interface{}
+}
+
+// ResolverFunc adapts an ordinary function to the Resolver interface.
+type ResolverFunc func(key string, versions []*data.Data) interface{}
+
+// Resolve calls f(key, versions).
+func (f ResolverFunc) Resolve(key string, versions []*data.Data) interface{} {
+	return f(key, versions)
+}
+
+// LastWriteWins resolves conflicts by keeping the value with the latest
+// Timestamp.
+var LastWriteWins Resolver = ResolverFunc(func(key string, versions []*data.Data) interface{} {
+	latest := versions[0]
+
+	for _, version := range versions[1:] {
+		if version.IsLater(latest) {
+			latest = version
+		}
+	}
+
+	return latest.Value
+})
+
+// MaxValue resolves conflicts by keeping the largest value. Numbers are
+// compared numerically and strings lexicographically. Values of any other
+// type are ignored unless there are no comparable values.
+var MaxValue Resolver = ResolverFunc(func(key string, versions []*data.Data) interface{} {
+	var max interface{}
+
+	for _, version := range versions {
+		if max == nil || greater(version.Value, max) {
+			max = version.Value
+		}
+	}
+
+	return max
+})
+
+// SetUnion resolves conflicts by combining slice or map values. Slices are
+// merged without duplicates and maps are merged key by key. The result has
+// the type of the first slice or map value found.
+var SetUnion Resolver = ResolverFunc(func(key string, versions []*data.Data) interface{} {
+	var union reflect.Value
+
+	for _, version := range versions {
+		value := reflect.ValueOf(version.Value)
+
+		if !value.IsValid() {
+			continue
+		}
+
+		if !union.IsValid() {
+			switch value.Kind() {
+			case reflect.Slice:
+				union = reflect.MakeSlice(value.Type(), 0, value.Len())
+			case reflect.Map:
+				union = reflect.MakeMap(value.Type())
+			default:
+				continue
+			}
+		}
+
+		if value.Type() != union.Type() {
+			continue
+		}
+
+		switch value.Kind() {
+		case reflect.Slice:
+			for i := 0; i < value.Len(); i++ {
+				if !contains(union, value.Index(i)) {
+					union = reflect.Append(union, value.Index(i))
+				}
+			}
+		case reflect.Map:
+			for _, k := range value.MapKeys() {
+				union.SetMapIndex(k, value.MapIndex(k))
+			}
+		}
+	}
+
+	if !union.IsValid() {
+		return LastWriteWins.Resolve(key, versions)
+	}
+
+	return union.Interface()
+})
+
+// contains returns true if the slice has an element equal to item.
+func contains(slice reflect.Value, item reflect.Value) bool {
+	for i := 0; i < slice.Len(); i++ {
+		if reflect.DeepEqual(slice.Index(i).Interface(), item.Interface()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// number converts numeric values to float64 so they can be compared.
+func number(value interface{}) (float64, bool) {
+	v := reflect.ValueOf(value)
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+
+	return 0, false
+}
+
+// greater returns true if a is larger than b. Numbers are greater than
+// strings, which are greater than values that can't be compared.
+func greater(a, b interface{}) bool {
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		return !ok || x > y
+	}
+
+	if _, ok := number(b); ok {
+		return false
+	}
+
+	if x, ok := a.(string); ok {
+		y, ok := b.(string)
+		return !ok || x > y
+	}
+
+	return false
+}
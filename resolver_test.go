@@ -0,0 +1,62 @@
+package toystore
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rlayte/toystore/data"
+)
+
+func values(items ...interface{}) []*data.Data {
+	versions := []*data.Data{}
+
+	for _, item := range items {
+		versions = append(versions, data.New("foo", item))
+	}
+
+	return versions
+}
+
+func TestMaxValue(t *testing.T) {
+	if v := MaxValue.Resolve("foo", values(3, 10, 7)); v != 10 {
+		t.Errorf("Max should be 10, but was %v", v)
+	}
+
+	if v := MaxValue.Resolve("foo", values("a", "c", "b")); v != "c" {
+		t.Errorf("Max should be c, but was %v", v)
+	}
+}
+
+func TestSetUnion(t *testing.T) {
+	v := SetUnion.Resolve("foo", values([]string{"a", "b"}, []string{"b", "c"}))
+
+	if !reflect.DeepEqual(v, []string{"a", "b", "c"}) {
+		t.Errorf("Union should be [a b c], but was %v", v)
+	}
+
+	v = SetUnion.Resolve("foo", values(map[string]int{"a": 1}, map[string]int{"b": 2}))
+
+	if !reflect.DeepEqual(v, map[string]int{"a": 1, "b": 2}) {
+		t.Errorf("Union should contain both keys, but was %v", v)
+	}
+}
+
+func TestMergeUsesResolver(t *testing.T) {
+	node := newLocalNode()
+	node.Resolver = SetUnion
+	node.Put("cart", []string{"milk"})
+
+	_, context, _ := node.GetVersions("cart")
+	node.PutVersion("cart", []string{"milk", "eggs"}, context)
+	node.PutVersion("cart", []string{"milk", "bread"}, context)
+
+	versions, _, _ := node.GetVersions("cart")
+
+	if len(versions) != 1 {
+		t.Fatalf("Resolver should leave one version, found %v", versions)
+	}
+
+	if len(versions[0].([]string)) != 3 {
+		t.Errorf("Cart should contain every item, but was %v", versions[0])
+	}
+}
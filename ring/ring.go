@@ -2,193 +2,452 @@ package ring
 
 import (
 	"bytes"
-	"container/list"
 	"crypto/sha256"
+	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 // Hash is the hashing function used to determine a nodes position in the
 // ring and to find the appropriate node for a given key.
-var Hash func([]byte) []byte = func(bytes []byte) []byte {
-	hash := sha256.New()
-	hash.Write(bytes)
-	return hash.Sum(nil)
+var Hash func([]byte) []byte = sha256Hash
+
+// sha256Hash returns the SHA-256 digest of bytes.
+func sha256Hash(bytes []byte) []byte {
+	hash := sha256.Sum256(bytes)
+	return hash[:]
+}
+
+// position is a token's place in the ring. The hash is computed once when
+// the token is added.
+type position struct {
+	hash    []byte
+	name    string
+	address string
+}
+
+// Replica is an entry in a key's preference list.
+type Replica struct {
+	// Address of a live node that should store the key.
+	Address string
+
+	// Address of the failed node Address is standing in for, or empty if
+	// Address is one of the key's own replicas.
+	HintFor string
+}
+
+// PreferenceList is the ordered list of nodes responsible for a key. The
+// first entry is the key's primary replica.
+type PreferenceList []Replica
+
+// Contains returns true if address is in the list.
+func (p PreferenceList) Contains(address string) bool {
+	for _, replica := range p {
+		if replica.Address == address {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SizeError is returned by FindN when the ring doesn't have enough live
+// members to fill a preference list.
+type SizeError struct {
+	Required  int
+	Available int
 }
 
-// lessThan returns true is the hashed value of a is less than the hashed
-// value of b. Otherwise it returns false.
-func lessThan(a *list.Element, b string) bool {
-	return bytes.Compare(Hash([]byte(a.Value.(string))), Hash([]byte(b))) < 1
+func (e *SizeError) Error() string {
+	return fmt.Sprintf("ring: %d live members required but only %d available", e.Required, e.Available)
 }
 
 type Ring interface {
 	Add(member string)
+	SetWeight(member string, weight int)
 	Find(key string) (member string)
-	FindN(key string, n int) (members map[string]string)
+	FindN(key string, n int) (replicas PreferenceList, err error)
 	Fail(member string)
 	Revive(member string)
-	Adjacent(a, b string) bool
+	Remove(member string)
+	Members() []string
+	Range(key string) (token string)
+	Ranges(n int) map[string]PreferenceList
+	Copy() Ring
 }
 
 // HashRing maintains a list of members and their position in the cluster
 // based on a consistent hashing function.
+// Each member owns Tokens positions in the ring (virtual nodes) for each
+// unit of weight, so keys are spread more evenly, members with more capacity
+// own proportionally more ranges, and a member's ranges are taken over by
+// many others when it fails.
 // If a node fails it remains in the list but is marked as failed.
+//
+// HashRing is safe for concurrent use. Lookups read an immutable snapshot
+// of the ring without locking. Changes are serialized, applied to a copy of
+// the current snapshot, and then published atomically, so readers never see
+// a partially applied change.
 type HashRing struct {
-	list   *list.List
-	failed map[string]bool
-	lock   *sync.Mutex
+	// Number of tokens each member is given per unit of weight. Must be set
+	// before any members are added.
+	Tokens int
+
+	current atomic.Pointer[snapshot]
+	lock    *sync.Mutex
 }
 
-// findElement iterates over the node until it finds a node greater
-// than the key.
-// If a node isn't found it returns the head of the list.
-func (h *HashRing) findElement(key string) *list.Element {
-	current := h.list.Front()
+// snapshot is an immutable state of the ring. Tokens are kept sorted by
+// hash so lookups are a binary search.
+type snapshot struct {
+	tokens  []position
+	weights map[string]int
+	failed  map[string]bool
+}
 
-	for lessThan(current, key) {
-		current = current.Next()
+// token returns the name of a member's i-th token. The first token is the
+// member's address so a ring with one token per member places members
+// exactly as before.
+func token(member string, i int) string {
+	if i == 0 {
+		return member
+	}
 
-		if current == nil {
-			current = h.list.Front()
-			break
+	return fmt.Sprintf("%s#%d", member, i)
+}
+
+// clone returns a deep copy of the snapshot that can be changed without
+// affecting readers of the original.
+func (s *snapshot) clone() *snapshot {
+	c := &snapshot{
+		tokens:  make([]position, len(s.tokens)),
+		weights: make(map[string]int, len(s.weights)),
+		failed:  make(map[string]bool, len(s.failed)),
+	}
+
+	copy(c.tokens, s.tokens)
+
+	for address, weight := range s.weights {
+		c.weights[address] = weight
+	}
+
+	for address, failed := range s.failed {
+		c.failed[address] = failed
+	}
+
+	return c
+}
+
+// search returns the index of the first token whose hash is greater than
+// the key's. If there isn't one it wraps around to the first token.
+// Returns -1 if the ring is empty.
+func (s *snapshot) search(key string) int {
+	if len(s.tokens) == 0 {
+		return -1
+	}
+
+	hash := Hash([]byte(key))
+	i := sort.Search(len(s.tokens), func(i int) bool {
+		return bytes.Compare(s.tokens[i].hash, hash) > 0
+	})
+
+	return i % len(s.tokens)
+}
+
+// setWeight gives the address weight * tokens tokens.
+func (s *snapshot) setWeight(address string, weight int, tokens int) {
+	current := s.weights[address] * tokens
+	target := weight * tokens
+
+	for i := current; i < target; i++ {
+		name := token(address, i)
+		s.tokens = append(s.tokens, position{Hash([]byte(name)), name, address})
+	}
+
+	if target < current {
+		removed := map[string]bool{}
+
+		for i := target; i < current; i++ {
+			removed[token(address, i)] = true
 		}
+
+		kept := s.tokens[:0]
+
+		for _, p := range s.tokens {
+			if !removed[p.name] {
+				kept = append(kept, p)
+			}
+		}
+
+		s.tokens = kept
 	}
 
-	return current
+	sort.SliceStable(s.tokens, func(i, j int) bool {
+		return bytes.Compare(s.tokens[i].hash, s.tokens[j].hash) < 0
+	})
+
+	s.weights[address] = weight
+}
+
+// snapshot returns the current state of the ring. It must not be changed.
+func (h *HashRing) snapshot() *snapshot {
+	return h.current.Load()
+}
+
+// update applies change to a copy of the current snapshot and publishes
+// it. Updates are serialized so none are lost.
+func (h *HashRing) update(change func(s *snapshot)) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	next := h.snapshot().clone()
+	change(next)
+	h.current.Store(next)
 }
 
-// String returns a comma separated list of addresses.
+// String returns a comma separated list of tokens.
 func (h *HashRing) String() string {
-	current := h.list.Front()
-	addresses := []string{}
+	s := h.snapshot()
+	names := make([]string, len(s.tokens))
 
-	for current != nil {
-		addresses = append(addresses, current.Value.(string))
-		current = current.Next()
+	for i, p := range s.tokens {
+		names[i] = p.name
 	}
 
-	return strings.Join(addresses, ", ")
+	return strings.Join(names, ", ")
 }
 
-// Add finds the first node that is higher than the address and inserts
-// a new node before it.
+// Add inserts the address into the ring with a weight of 1. Adding an
+// address that's already in the ring has no effect.
 func (h *HashRing) Add(address string) {
-	if h.list.Len() == 0 {
-		h.list.PushBack(address)
-	} else {
-		target := h.findElement(address)
-
-		if lessThan(target, address) {
-			h.list.PushBack(address)
-		} else {
-			h.list.InsertBefore(address, target)
+	if _, ok := h.snapshot().weights[address]; ok {
+		return
+	}
+
+	h.update(func(s *snapshot) {
+		if _, ok := s.weights[address]; !ok {
+			s.setWeight(address, 1, h.tokens())
 		}
+	})
+}
+
+// SetWeight gives the address weight * Tokens tokens, adding it to the ring
+// if it isn't already a member.
+// Tokens are named after the address and their index, so changing a weight
+// only inserts or removes the tokens above the smaller count. Every other
+// range keeps its owner.
+func (h *HashRing) SetWeight(address string, weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+
+	if current, ok := h.snapshot().weights[address]; ok && current == weight {
+		return
 	}
+
+	h.update(func(s *snapshot) {
+		s.setWeight(address, weight, h.tokens())
+	})
 }
 
-// Find returns the node that owns the range the key falls within.
+// tokens returns the number of tokens per unit of weight, which is at
+// least 1.
+func (h *HashRing) tokens() int {
+	if h.Tokens < 1 {
+		return 1
+	}
+
+	return h.Tokens
+}
+
+// Find returns the first alive node that owns the range the key falls
+// within.
 // TODO: Should this return hinted addresses if the node is dead?
 func (h *HashRing) Find(key string) string {
-	element := h.findElement(key)
+	s := h.snapshot()
+	start := s.search(key)
 
-	if element != nil {
-		address := element.Value.(string)
+	for i := 0; start >= 0 && i < len(s.tokens); i++ {
+		address := s.tokens[(start+i)%len(s.tokens)].address
 
-		for h.failed[address] {
-			next := element.Next()
+		if !s.failed[address] {
+			return address
+		}
+	}
 
-			if next == nil {
-				next = h.list.Front()
-			}
+	return ""
+}
 
-			address = next.Value.(string)
+// FindN returns the preference list for the key: n distinct alive nodes in
+// ring order starting with the closest to the provided key.
+// Tokens are walked clockwise and each physical node is only considered
+// once. If one of the first n nodes is dead the next alive node after them
+// takes its place in the list, with HintFor set to the dead node's address.
+// If there are fewer than n alive nodes it returns every alive node along
+// with a SizeError.
+func (h *HashRing) FindN(key string, n int) (PreferenceList, error) {
+	s := h.snapshot()
+	return s.preference(s.search(key), n)
+}
+
+// preference returns the preference list of the range ending at the token
+// at index start. See FindN.
+func (s *snapshot) preference(start int, n int) (PreferenceList, error) {
+	seen := map[string]bool{}
+	walk := []string{}
+
+	alive := 0
+
+	// Stop walking once the first n nodes have been found and there are
+	// enough alive nodes to stand in for any that have failed.
+	for i := 0; start >= 0 && i < len(s.tokens) && (len(walk) < n || alive < n); i++ {
+		address := s.tokens[(start+i)%len(s.tokens)].address
+
+		if seen[address] {
+			continue
 		}
 
-		return address
-	} else {
-		return ""
+		seen[address] = true
+		walk = append(walk, address)
+
+		if !s.failed[address] {
+			alive++
+		}
+
+		if len(walk) == len(s.weights) {
+			break
+		}
 	}
-}
 
-// FindN returns n alive nodes starting with the closest to the provided key.
-// If a node is dead the next alive node will be returned in its place with a
-// hint to the real address.
-// Returns a map where keys are addresses and values are hints. If the key and
-// value are the same then the node is alive.
-func (h *HashRing) FindN(key string, n int) map[string]string {
-	target := h.findElement(key)
-	ret := map[string]string{}
+	length := n
 
-	if target == nil {
-		return ret
+	if length > len(walk) {
+		length = len(walk)
 	}
 
-	for len(ret) < n {
-		address := target.Value.(string)
-		hint := address
+	preference, fallback := walk[:length], walk[length:]
+	replicas := PreferenceList{}
 
-		for h.failed[address] {
-			next := target.Next()
+	for _, address := range preference {
+		if !s.failed[address] {
+			replicas = append(replicas, Replica{address, ""})
+			continue
+		}
 
-			for i := 0; i < n-1; i++ {
-				if next == nil {
-					next = h.list.Front()
-				} else {
-					next = next.Next()
-				}
-			}
+		for len(fallback) > 0 {
+			next := fallback[0]
+			fallback = fallback[1:]
 
-			if next == nil {
-				next = h.list.Front()
+			if !s.failed[next] {
+				replicas = append(replicas, Replica{next, address})
+				break
 			}
-
-			address = next.Value.(string)
 		}
+	}
 
-		ret[address] = hint
-		target = target.Next()
+	if len(replicas) < n {
+		return replicas, &SizeError{n, len(replicas)}
+	}
 
-		if target == nil {
-			target = h.list.Front()
-		}
+	return replicas, nil
+}
+
+// Range returns the name of the token that ends the range the key falls
+// within. Every key in a range has the same preference list. Returns an
+// empty string if the ring is empty.
+func (h *HashRing) Range(key string) string {
+	s := h.snapshot()
+	i := s.search(key)
+
+	if i < 0 {
+		return ""
 	}
 
-	return ret
+	return s.tokens[i].name
 }
 
-// Adjacent returns true if the addresses are next to each other in the ring.
-func (h *HashRing) Adjacent(a, b string) bool {
-	nodeA := h.findElement(a)
-	nodeB := h.findElement(b)
+// Ranges returns the preference list of n nodes for every range in the
+// ring, keyed by the name of the token that ends it.
+func (h *HashRing) Ranges(n int) map[string]PreferenceList {
+	s := h.snapshot()
+	ranges := make(map[string]PreferenceList, len(s.tokens))
 
-	if nodeA != nil {
-		next := nodeA.Next()
+	for i, p := range s.tokens {
+		ranges[p.name], _ = s.preference(i, n)
+	}
 
-		if next == nil {
-			next = h.list.Front()
-		}
+	return ranges
+}
 
-		return next == nodeB
-	} else {
-		return false
+// Members returns the address of every member that hasn't failed in the
+// order their first tokens appear in the ring.
+func (h *HashRing) Members() []string {
+	s := h.snapshot()
+	members := []string{}
+	seen := map[string]bool{}
+
+	for _, p := range s.tokens {
+		address := p.address
+
+		if !s.failed[address] && !seen[address] {
+			seen[address] = true
+			members = append(members, address)
+		}
 	}
+
+	return members
 }
 
 // Fail marks member as failed, but doesn't remove it from the ring.
 func (h *HashRing) Fail(member string) {
-	h.failed[member] = true
+	h.update(func(s *snapshot) {
+		s.failed[member] = true
+	})
 }
 
 // Revive removes the member from the failed list.
 func (h *HashRing) Revive(member string) {
-	delete(h.failed, member)
+	h.update(func(s *snapshot) {
+		delete(s.failed, member)
+	})
+}
+
+// Remove deletes every token owned by the member so its ranges are taken
+// over by the next members in the ring. Unlike Fail this is permanent; the
+// member has to be added again to rejoin.
+func (h *HashRing) Remove(member string) {
+	h.update(func(s *snapshot) {
+		s.setWeight(member, 0, h.tokens())
+		delete(s.weights, member)
+		delete(s.failed, member)
+	})
 }
 
+// Copy returns a ring with the same members that can be changed without
+// affecting this one.
+func (h *HashRing) Copy() Ring {
+	c := &HashRing{Tokens: h.Tokens, lock: &sync.Mutex{}}
+
+	// Snapshots are never changed once published, so they can be shared.
+	c.current.Store(h.snapshot())
+
+	return c
+}
+
+// NewHashRing returns an empty ring that gives each member a single token.
 func NewHashRing() *HashRing {
-	return &HashRing{
-		list:   list.New(),
-		failed: map[string]bool{},
+	h := &HashRing{
+		Tokens: 1,
 		lock:   &sync.Mutex{},
 	}
+
+	h.current.Store(&snapshot{
+		tokens:  []position{},
+		weights: map[string]int{},
+		failed:  map[string]bool{},
+	})
+
+	return h
 }
@@ -1,8 +1,9 @@
 package ring
 
 import (
-	"container/list"
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -12,25 +13,28 @@ func init() {
 	}
 }
 
-func TestRinglessThan(t *testing.T) {
-	cases := map[string]string{
-		"a": "b",
-		"c": "d",
-		"f": "j",
-	}
+func TestRingSearch(t *testing.T) {
+	ring := NewHashRing()
+	ring.Add("b")
+	ring.Add("d")
+	s := ring.snapshot()
 
-	for a, b := range cases {
-		if lessThan(&list.Element{Value: a}, b) != true {
-			t.Errorf("%s should be less than %s", a, b)
-		}
+	cases := map[string]int{
+		"a": 0,
+		"b": 1,
+		"c": 1,
+		"d": 0,
+		"e": 0,
+	}
 
-		if lessThan(&list.Element{Value: b}, a) == true {
-			t.Errorf("%s should not be less than %s", a, b)
+	for key, index := range cases {
+		if s.search(key) != index {
+			t.Errorf("%s should be located at %d, not %d", key, index, s.search(key))
 		}
 	}
 
-	if lessThan(&list.Element{Value: "a"}, "a") != true {
-		t.Errorf("The same value should return true")
+	if NewHashRing().snapshot().search("a") != -1 {
+		t.Error("Searching an empty ring should return -1")
 	}
 }
 
@@ -78,16 +82,14 @@ func TestRingFindN(t *testing.T) {
 	ring.Add("b")
 	ring.Add("a")
 
-	nodes := ring.FindN("c", 3)
+	nodes, err := ring.FindN("c", 3)
 
-	if len(nodes) != 3 {
-		t.Error("FindN should return N keys")
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	for _, key := range []string{"d", "e", "a"} {
-		if _, ok := nodes[key]; !ok {
-			t.Errorf("Nodes should contain %s", key)
-		}
+	if fmt.Sprint(nodes) != "[{d } {e } {a }]" {
+		t.Errorf("FindN should return d, e, a in order, but returned %v", nodes)
 	}
 }
 
@@ -100,43 +102,341 @@ func TestRingFindNWithFailures(t *testing.T) {
 
 	ring.Fail("e")
 
-	nodes := ring.FindN("c", 3)
-
-	if len(nodes) != 3 {
-		t.Error("FindN should return N keys")
-	}
+	nodes, err := ring.FindN("c", 3)
 
-	if nodes["b"] != "e" {
-		t.Errorf("Hint should have been d, but was %s", nodes)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	for _, key := range []string{"d", "a", "b"} {
-		if _, ok := nodes[key]; !ok {
-			t.Errorf("Nodes should contain %s", key)
-		}
+	if fmt.Sprint(nodes) != "[{d } {b e} {a }]" {
+		t.Errorf("b should replace e with a hint, but returned %v", nodes)
 	}
 }
 
-func TestRingAdjacent(t *testing.T) {
+func TestRingFindNWithAdjacentFailures(t *testing.T) {
 	ring := NewHashRing()
 	ring.Add("d")
 	ring.Add("e")
 	ring.Add("b")
 	ring.Add("a")
+	ring.Add("f")
+
+	ring.Fail("d")
+	ring.Fail("e")
+
+	nodes, err := ring.FindN("c", 3)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(nodes) != "[{a d} {b e} {f }]" {
+		t.Errorf("FindN should return 3 distinct live nodes, but returned %v", nodes)
+	}
+}
+
+func TestRingFindNTooSmall(t *testing.T) {
+	ring := NewHashRing()
+	ring.Add("a")
+	ring.Add("b")
+	ring.Add("c")
+	ring.Fail("b")
+
+	nodes, err := ring.FindN("a", 3)
+
+	if _, ok := err.(*SizeError); !ok {
+		t.Errorf("Expected a SizeError, got %v", err)
+	}
+
+	if fmt.Sprint(nodes) != "[{c } {a }]" {
+		t.Errorf("FindN should return every live node, but returned %v", nodes)
+	}
+
+	if _, err := NewHashRing().FindN("a", 1); err == nil {
+		t.Error("Empty ring should return an error")
+	}
+}
+
+func TestRingMembers(t *testing.T) {
+	ring := NewHashRing()
+	ring.Add("c")
+	ring.Add("a")
+	ring.Add("b")
+	ring.Fail("b")
+
+	if fmt.Sprint(ring.Members()) != "[a c]" {
+		t.Errorf("Members should be [a c], but was %v", ring.Members())
+	}
+}
+
+func TestRingVirtualNodes(t *testing.T) {
+	ring := NewHashRing()
+	ring.Tokens = 3
+	ring.Add("a")
+	ring.Add("b")
+	ring.Add("a")
+
+	if fmt.Sprint(ring) != "a, a#1, a#2, b, b#1, b#2" {
+		t.Errorf("Each member should have 3 tokens: %s", ring)
+	}
+
+	if ring.Find("a#0") != "a" {
+		t.Errorf("a#0 is located on a#1, not %s", ring.Find("a#0"))
+	}
+
+	nodes, _ := ring.FindN("a#0", 2)
+
+	if fmt.Sprint(nodes) != "[{a } {b }]" {
+		t.Errorf("FindN should return distinct members: %v", nodes)
+	}
+
+	if fmt.Sprint(ring.Members()) != "[a b]" {
+		t.Errorf("Members should be [a b], but was %v", ring.Members())
+	}
+}
+
+func TestRingFindSkipsFailedTokens(t *testing.T) {
+	ring := NewHashRing()
+	ring.Tokens = 2
+	ring.Add("a")
+	ring.Add("b")
+	ring.Add("c")
+	ring.Fail("b")
+
+	if ring.Find("a#1") != "c" {
+		t.Errorf("a#1 should be located on c when b fails, not %s", ring.Find("a#1"))
+	}
+
+	ring.Fail("a")
+	ring.Fail("c")
 
-	if ring.Adjacent("c", "b") != true {
-		t.Error("a should be next to b:", ring)
+	if ring.Find("a") != "" {
+		t.Error("Find should return nothing when every member has failed")
 	}
+}
+
+func TestRingRemove(t *testing.T) {
+	ring := NewHashRing()
+	ring.Tokens = 2
+	ring.Add("a")
+	ring.Add("b")
+	ring.Add("c")
+	ring.Fail("b")
+	ring.Remove("b")
+
+	if fmt.Sprint(ring) != "a, a#1, c, c#1" {
+		t.Errorf("b's tokens should be removed: %s", ring)
+	}
+
+	if nodes, err := ring.FindN("a#1", 2); err != nil || fmt.Sprint(nodes) != "[{c } {a }]" {
+		t.Errorf("b's range should be owned by c without a hint: %v %v", nodes, err)
+	}
+
+	ring.Add("b")
+
+	if fmt.Sprint(ring.Members()) != "[a b c]" {
+		t.Errorf("b should be alive after rejoining: %v", ring.Members())
+	}
+}
+
+func TestRingSetWeight(t *testing.T) {
+	ring := NewHashRing()
+	ring.Tokens = 2
+	ring.Add("a")
+	ring.SetWeight("b", 2)
+
+	if fmt.Sprint(ring) != "a, a#1, b, b#1, b#2, b#3" {
+		t.Errorf("b should have twice as many tokens as a: %s", ring)
+	}
+
+	ring.SetWeight("a", 2)
 
-	if ring.Adjacent("a", "b") != true {
-		t.Error("a should be next to b:", ring)
+	if fmt.Sprint(ring) != "a, a#1, a#2, a#3, b, b#1, b#2, b#3" {
+		t.Errorf("a should have 4 tokens: %s", ring)
 	}
 
-	if ring.Adjacent("e", "a") != true {
-		t.Error("e should be next to a:", ring)
+	if ring.Find("a#0") != "a" || ring.Find("b#0") != "b" {
+		t.Error("Existing ranges should keep their owners")
+	}
+
+	ring.SetWeight("b", 1)
+
+	if fmt.Sprint(ring) != "a, a#1, a#2, a#3, b, b#1" {
+		t.Errorf("b should have 2 tokens: %s", ring)
+	}
+}
+
+func TestRingConcurrentUpdates(t *testing.T) {
+	ring := NewHashRing()
+	ring.Tokens = 4
+	members := []string{"a", "b", "c", "d", "e", "f"}
+	wg := sync.WaitGroup{}
+
+	for _, member := range members {
+		wg.Add(2)
+
+		go func(member string) {
+			defer wg.Done()
+
+			for i := 0; i < 50; i++ {
+				ring.Add(member)
+				ring.Fail(member)
+				ring.Revive(member)
+			}
+		}(member)
+
+		go func(member string) {
+			defer wg.Done()
+
+			for i := 0; i < 50; i++ {
+				if nodes, err := ring.FindN(member, 3); err == nil && len(nodes) != 3 {
+					t.Errorf("FindN returned %v without an error", nodes)
+				}
+
+				ring.Find(member)
+				ring.Members()
+			}
+		}(member)
+	}
+
+	wg.Wait()
+
+	if len(ring.Members()) != len(members) {
+		t.Errorf("Every member should be alive, but ring had %v", ring.Members())
+	}
+
+	if len(strings.Split(ring.String(), ", ")) != len(members)*4 {
+		t.Errorf("Concurrent adds should not be lost: %s", ring)
+	}
+}
+
+func TestRingSnapshotIsolation(t *testing.T) {
+	ring := NewHashRing()
+	ring.Add("a")
+	ring.Add("b")
+
+	before := ring.snapshot()
+	ring.Fail("a")
+	ring.Add("c")
+
+	if before.failed["a"] || len(before.tokens) != 2 {
+		t.Error("Updates should not change existing snapshots")
+	}
+}
+
+// benchmarkRing returns a ring with the given number of members and tokens
+// per member using the real hash function.
+func benchmarkRing(b *testing.B, members int, tokens int) *HashRing {
+	hash := Hash
+	Hash = sha256Hash
+	b.Cleanup(func() { Hash = hash })
+
+	ring := NewHashRing()
+	ring.Tokens = tokens
+
+	for i := 0; i < members; i++ {
+		ring.Add(fmt.Sprintf("10.0.0.%d:3001", i))
+	}
+
+	b.ResetTimer()
+
+	return ring
+}
+
+func BenchmarkRingFind1k(b *testing.B) {
+	ring := benchmarkRing(b, 16, 64)
+
+	for i := 0; i < b.N; i++ {
+		ring.Find(fmt.Sprint(i))
+	}
+}
+
+func BenchmarkRingFind16k(b *testing.B) {
+	ring := benchmarkRing(b, 64, 256)
+
+	for i := 0; i < b.N; i++ {
+		ring.Find(fmt.Sprint(i))
+	}
+}
+
+func BenchmarkRingFindN1k(b *testing.B) {
+	ring := benchmarkRing(b, 16, 64)
+
+	for i := 0; i < b.N; i++ {
+		ring.FindN(fmt.Sprint(i), 3)
+	}
+}
+
+func BenchmarkRingFindN16k(b *testing.B) {
+	ring := benchmarkRing(b, 64, 256)
+
+	for i := 0; i < b.N; i++ {
+		ring.FindN(fmt.Sprint(i), 3)
+	}
+}
+
+func BenchmarkRingAdd1k(b *testing.B) {
+	ring := benchmarkRing(b, 16, 64)
+
+	for i := 0; i < b.N; i++ {
+		ring.SetWeight("10.0.0.0:3001", 2)
+		ring.SetWeight("10.0.0.0:3001", 1)
+	}
+}
+
+func TestRingRanges(t *testing.T) {
+	ring := NewHashRing()
+	ring.Add("b")
+	ring.Add("d")
+	ring.Add("f")
+	ring.Fail("d")
+
+	cases := map[string]string{
+		"a": "b",
+		"c": "d",
+		"e": "f",
+		"g": "b",
+	}
+
+	for key, token := range cases {
+		if ring.Range(key) != token {
+			t.Errorf("%s should be in the range ending at %s, not %s", key, token, ring.Range(key))
+		}
+	}
+
+	ranges := ring.Ranges(2)
+
+	if len(ranges) != 3 {
+		t.Fatalf("Expected 3 ranges, got %d", len(ranges))
+	}
+
+	for key := range cases {
+		expected, _ := ring.FindN(key, 2)
+
+		if fmt.Sprint(ranges[ring.Range(key)]) != fmt.Sprint(expected) {
+			t.Errorf("Range of %s should have preference list %v, got %v", key, expected, ranges[ring.Range(key)])
+		}
+	}
+
+	if NewHashRing().Range("a") != "" {
+		t.Error("Empty rings have no ranges")
+	}
+}
+
+func TestRingCopy(t *testing.T) {
+	ring := NewHashRing()
+	ring.Add("b")
+	ring.Add("d")
+
+	c := ring.Copy()
+	c.Add("f")
+	c.Fail("b")
+
+	if fmt.Sprint(ring.Members()) != "[b d]" {
+		t.Errorf("Changing a copy should not change the ring, but members are %v", ring.Members())
 	}
 
-	if ring.Adjacent("a", "d") == true {
-		t.Error("a should not be next to d:", ring)
+	if fmt.Sprint(c.Members()) != "[d f]" {
+		t.Errorf("Copy should have its own changes, but members are %v", c.Members())
 	}
 }
@@ -1,26 +1,56 @@
 package toystore
 
-import "github.com/rlayte/toystore/data"
+import (
+	"time"
+
+	"github.com/rlayte/toystore/data"
+	"github.com/rlayte/toystore/merkle"
+)
 
 // GetArgs is used to request data from other nodes.
 type GetArgs struct {
 	Key string
+	// Time the caller stops waiting. Zero if there's no deadline.
+	Deadline time.Time
+	// Address of the failed node the receiver is standing in for when
+	// reading hints.
+	Hint string
+	// Number of successful reads the coordinator waits for. Zero uses the
+	// coordinator's R.
+	R int
 }
 
 // GetReply is used to send data to other nodes.
 type GetReply struct {
 	Value *data.Data
 	Ok    bool
+	// Number of successful reads and the number required when
+	// coordinating. Used to report quorum errors to the caller.
+	Acks     int
+	Required int
+	// True if the coordinator ran out of time.
+	Timeout bool
 }
 
 // PutArgs is used to write data on other nodes.
 type PutArgs struct {
 	Value *data.Data
+	// Time the caller stops waiting. Zero if there's no deadline.
+	Deadline time.Time
+	// Number of successful writes the coordinator waits for. Zero uses the
+	// coordinator's W.
+	W int
 }
 
 // PutReply is used to send write status to other nodes.
 type PutReply struct {
 	Ok bool
+	// Number of successful writes and the number required when
+	// coordinating. Used to report quorum errors to the caller.
+	Acks     int
+	Required int
+	// True if the coordinator ran out of time.
+	Timeout bool
 }
 
 // HintArgs is used to store hinted data temporarily on other nodes.
@@ -38,9 +68,76 @@ type HintReply struct {
 // TransferArgs is used to send chunks of data to other nodes.
 type TransferArgs struct {
 	Data []*data.Data
+	// Identifies the chunk so the receiver's acknowledgement can be
+	// matched to it.
+	Batch uint64
 }
 
 // TransferReply is used to send transfer status to other nodes.
 type TransferReply struct {
 	Ok bool
+	// Batch of the TransferArgs that was stored.
+	Batch uint64
+}
+
+// PingArgs is used to check a connection to another node is healthy.
+type PingArgs struct{}
+
+// PingReply is used to respond to health checks.
+type PingReply struct{}
+
+// MerkleTreesArgs is used to request the Merkle trees of the ranges another
+// node shares with Peer.
+type MerkleTreesArgs struct {
+	Peer string
+}
+
+// MerkleTreesReply is used to send Merkle trees to other nodes, keyed by
+// range.
+type MerkleTreesReply struct {
+	Trees map[string]*merkle.Tree
+}
+
+// MerkleSyncArgs is used to exchange the values in Merkle tree leaves that
+// differ between two nodes.
+type MerkleSyncArgs struct {
+	Peer   string
+	Leaves map[string][]int
+	Data   []*data.Data
+}
+
+// MerkleSyncReply is used to send the values in the requested leaves back
+// to the other node.
+type MerkleSyncReply struct {
+	Data []*data.Data
+}
+
+// RangesArgs is used to request a page of the keys a node stores that Peer
+// is a replica for. Only keys after Start are returned, up to Limit.
+type RangesArgs struct {
+	Peer   string
+	Weight int
+	Start  string
+	Limit  int
 }
+
+// RangesReply is used to send a page of a node's keys to a bootstrapping
+// peer. Next is the Start of the following page, or empty if this is the
+// last page.
+type RangesReply struct {
+	Data []*data.Data
+	Next string
+}
+
+// DecommissionArgs is used to ask a node to leave the cluster permanently.
+type DecommissionArgs struct{}
+
+// DecommissionReply is sent once the node has streamed its ranges.
+type DecommissionReply struct{}
+
+// BootstrapArgs is used to ask a node to stream its ranges from the
+// cluster.
+type BootstrapArgs struct{}
+
+// BootstrapReply is sent once the node has streamed its ranges.
+type BootstrapReply struct{}
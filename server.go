@@ -1,9 +1,12 @@
 package toystore
 
 import (
+	"context"
 	"encoding/gob"
 	"net"
 	"net/rpc"
+	"sync"
+	"time"
 
 	"github.com/rlayte/toystore/data"
 )
@@ -17,40 +20,125 @@ type PeerHandler interface {
 	CoordinatePut(args *PutArgs, reply *PutReply) error
 }
 
-// serve starts listening for RPC calls, and creates a new thread for
-// each incoming connection.
-func serve(address string, rpcs *rpc.Server) {
-	l, err := net.Listen("tcp", address)
-
-	if err != nil {
-		panic(err)
-	}
-
+// serve accepts RPC connections on the handler's listener, and creates a
+// new thread for each incoming connection. It returns once the listener
+// is closed.
+// Failed connections are logged and retried after a short delay.
+func (r *RpcHandler) serve(rpcs *rpc.Server) {
 	for {
-		conn, err := l.Accept()
+		conn, err := r.listener.Accept()
 
 		if err != nil {
-			panic(err)
+			if r.isClosed() {
+				return
+			}
+
+			r.store.log.Printf("Failed to accept connection: %s", err)
+			time.Sleep(time.Millisecond * 10)
+			continue
 		}
 
-		go rpcs.ServeConn(conn)
+		r.lock.Lock()
+		r.conns[conn] = true
+		r.lock.Unlock()
+
+		go func() {
+			rpcs.ServeConn(conn)
+
+			r.lock.Lock()
+			delete(r.conns, conn)
+			r.lock.Unlock()
+		}()
 	}
 }
 
 // RpcHandler implements PeerHandler using Go's RPC package.
 type RpcHandler struct {
-	store *Toystore
+	store    *Toystore
+	listener net.Listener
+
+	// Open connections so they can be closed with the listener.
+	conns  map[net.Conn]bool
+	closed bool
+	lock   *sync.Mutex
+}
+
+// isClosed returns true once Close has been called.
+func (r *RpcHandler) isClosed() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.closed
+}
+
+// Close stops accepting RPC calls and closes any open connections.
+func (r *RpcHandler) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return nil
+	}
+
+	r.closed = true
+
+	for conn := range r.conns {
+		conn.Close()
+	}
+
+	return r.listener.Close()
+}
+
+// requestContext returns a context that expires at the caller's deadline.
+func requestContext(deadline time.Time) (context.Context, context.CancelFunc) {
+	if deadline.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+
+	return context.WithDeadline(context.Background(), deadline)
+}
+
+// coordinateStatus sets the reply status fields from a coordinator's
+// error.
+func coordinateStatus(err error, ok *bool, timeout *bool, acks *int, required *int) {
+	*ok = err == nil
+
+	if quorum, isQuorum := err.(*QuorumError); isQuorum {
+		*acks = quorum.Acks
+		*required = quorum.Required
+	}
+
+	*timeout = err == ErrTimeout
 }
 
 // Get looks up and item from Toystore's underlying Store data.
 func (r *RpcHandler) Get(args *GetArgs, reply *GetReply) error {
+	if r.store.bootstrapping.Load() {
+		return ErrBootstrapping
+	}
+
 	reply.Value, reply.Ok = r.store.Data.Get(args.Key)
 	return nil
 }
 
-// Put adds a value directly to Toystore's underlying Store data.
+// HintGet returns the node's value for a key merged with any hint it holds
+// for the key on behalf of args.Hint.
+func (r *RpcHandler) HintGet(args *GetArgs, reply *GetReply) error {
+	if r.store.bootstrapping.Load() {
+		return ErrBootstrapping
+	}
+
+	reply.Value = r.store.hinted(args.Hint, args.Key)
+	reply.Ok = reply.Value != nil
+	return nil
+}
+
+// Put merges a value directly into Toystore's underlying Store data.
 func (r *RpcHandler) Put(args *PutArgs, reply *PutReply) error {
-	r.store.Data.Put(args.Value)
+	if r.store.decommissioning.Load() {
+		return ErrDecommissioning
+	}
+
+	r.store.Merge(args.Value)
 	reply.Ok = true
 	return nil
 }
@@ -58,41 +146,130 @@ func (r *RpcHandler) Put(args *PutArgs, reply *PutReply) error {
 // CoordinateGet kicks off the coordination process from a
 // non-coordinator node.
 func (r *RpcHandler) CoordinateGet(args *GetArgs, reply *GetReply) error {
-	reply.Value, reply.Ok = r.store.CoordinateGet(args.Key)
+	ctx, cancel := requestContext(args.Deadline)
+	defer cancel()
+
+	reads, err := r.store.reads(Options{R: args.R})
+
+	if err != nil {
+		return err
+	}
+
+	value, err := r.store.coordinateGet(ctx, args.Key, reads)
+	reply.Value = value
+	coordinateStatus(err, &reply.Ok, &reply.Timeout, &reply.Acks, &reply.Required)
+
 	return nil
 }
 
 // CoordinatePut kicks off the coordination process from a
 // non-coordinator node.
 func (r *RpcHandler) CoordinatePut(args *PutArgs, reply *PutReply) error {
-	reply.Ok = r.store.CoordinatePut(args.Value)
+	ctx, cancel := requestContext(args.Deadline)
+	defer cancel()
+
+	writes, err := r.store.writes(Options{W: args.W})
+
+	if err != nil {
+		return err
+	}
+
+	err = r.store.coordinatePut(ctx, args.Value, writes)
+	coordinateStatus(err, &reply.Ok, &reply.Timeout, &reply.Acks, &reply.Required)
+
 	return nil
 }
 
 // HintPut adds a new data hint to the node's HintedHandoff list.
 func (r *RpcHandler) HintPut(args *HintArgs, reply *HintReply) error {
+	if r.store.decommissioning.Load() {
+		return ErrDecommissioning
+	}
+
 	r.store.Hints.Put(args.Data, args.Hint)
 	reply.Ok = true
 	return nil
 }
 
-// Transfer adds a set of data to the node.
+// Ping responds to health checks from other nodes.
+func (r *RpcHandler) Ping(args *PingArgs, reply *PingReply) error {
+	return nil
+}
+
+// MerkleTrees returns the Merkle trees of the ranges the node shares with
+// the calling peer.
+func (r *RpcHandler) MerkleTrees(args *MerkleTreesArgs, reply *MerkleTreesReply) error {
+	reply.Trees = r.store.AntiEntropy.Trees(args.Peer)
+	return nil
+}
+
+// MerkleSync merges the peer's values for the leaves that differ and
+// returns the node's own values for the same leaves.
+func (r *RpcHandler) MerkleSync(args *MerkleSyncArgs, reply *MerkleSyncReply) error {
+	if r.store.decommissioning.Load() {
+		return ErrDecommissioning
+	}
+
+	reply.Data = r.store.AntiEntropy.Items(args.Peer, args.Leaves)
+	_, err := r.store.AntiEntropy.Merge(args.Data)
+	return err
+}
+
+// Transfer adds a set of data to the node and acknowledges the batch once
+// every item has been stored.
 func (r *RpcHandler) Transfer(args *TransferArgs, reply *TransferReply) error {
+	if r.store.decommissioning.Load() {
+		return ErrDecommissioning
+	}
+
 	for _, item := range args.Data {
 		r.store.Merge(item)
 	}
 
 	reply.Ok = true
+	reply.Batch = args.Batch
 	return nil
 }
 
+// Ranges returns a page of the keys the node stores that the calling peer
+// is a replica for.
+func (r *RpcHandler) Ranges(args *RangesArgs, reply *RangesReply) error {
+	reply.Data, reply.Next = r.store.Ranges(args.Peer, args.Weight, args.Start, args.Limit)
+	return nil
+}
+
+// Decommission streams the node's ranges to their new owners and removes it
+// from every member's ring. The node keeps running, without any ranges,
+// until its process is stopped.
+func (r *RpcHandler) Decommission(args *DecommissionArgs, reply *DecommissionReply) error {
+	return r.store.decommission()
+}
+
+// Bootstrap streams the node's ranges from the other nodes.
+func (r *RpcHandler) Bootstrap(args *BootstrapArgs, reply *BootstrapReply) error {
+	return r.store.Bootstrap()
+}
+
 // NewRpcHandler returns a new RpcHandler instance and starts serving requests.
-func NewRpcHandler(store *Toystore) *RpcHandler {
+// Returns a ListenError if it can't listen on the node's RPC address.
+func NewRpcHandler(store *Toystore) (*RpcHandler, error) {
 	gob.Register(data.Data{})
+
+	l, err := net.Listen("tcp", store.rpcAddress())
+
+	if err != nil {
+		return nil, &ListenError{store.rpcAddress(), err}
+	}
+
 	rpcs := rpc.NewServer()
-	s := &RpcHandler{store}
+	s := &RpcHandler{
+		store:    store,
+		listener: l,
+		conns:    map[net.Conn]bool{},
+		lock:     &sync.Mutex{},
+	}
 	rpcs.Register(s)
-	go serve(store.rpcAddress(), rpcs)
+	go s.serve(rpcs)
 
-	return s
+	return s, nil
 }
@@ -31,16 +31,22 @@ func (m MemoryStore) Put(d *data.Data) bool {
 	return true
 }
 
+// Delete removes the key and returns a success status bool.
+// Thread safe.
+func (m MemoryStore) Delete(key string) bool {
+	m.lock.Lock()
+	delete(m.data, key)
+	m.lock.Unlock()
+	return true
+}
+
 // Keys returns a list of all keys added to the store.
 // Thread safe.
 func (m MemoryStore) Keys() []string {
-	out := make([]string, len(m.data))
-	i := 0
-
 	m.lock.Lock()
+	out := make([]string, 0, len(m.data))
 	for key := range m.data {
-		out[i] = key
-		i++
+		out = append(out, key)
 	}
 	m.lock.Unlock()
 
@@ -1,6 +1,7 @@
 package memory
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/rlayte/toystore/data"
@@ -27,3 +28,33 @@ func TestFailure(t *testing.T) {
 	_, success := res.Get("lol")
 	Equal(t, success, false)
 }
+
+func TestDelete(t *testing.T) {
+	res := New()
+	res.Put(data.New("foo", "bar"))
+	res.Delete("foo")
+	_, success := res.Get("foo")
+	Equal(t, success, false)
+}
+
+func TestKeysConcurrent(t *testing.T) {
+	res := New()
+	done := make(chan bool)
+
+	go func() {
+		for i := 0; i < 1000; i++ {
+			res.Put(data.New(fmt.Sprint(i), "bar"))
+		}
+		close(done)
+	}()
+
+	for {
+		select {
+		case <-done:
+			Equal(t, len(res.Keys()), 1000)
+			return
+		default:
+			res.Keys()
+		}
+	}
+}
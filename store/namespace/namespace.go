@@ -0,0 +1,141 @@
+// Package namespace wraps a Store so it can be shared by several users
+// without their keys colliding, e.g. so a node's hints can be persisted
+// in the same backend as its data.
+package namespace
+
+import (
+	"io"
+	"strings"
+
+	"github.com/rlayte/toystore/data"
+	"github.com/rlayte/toystore/store"
+)
+
+// NamespaceStore keeps its keys in another Store with a prefix added.
+// Values are returned with the prefix removed from their keys, and Keys
+// only returns the keys within the namespace.
+type NamespaceStore struct {
+	store  store.Store
+	prefix string
+}
+
+// Get returns a Data value and existence bool for the given key.
+func (n NamespaceStore) Get(key string) (*data.Data, bool) {
+	value, ok := n.store.Get(n.prefix + key)
+
+	if !ok {
+		return nil, false
+	}
+
+	unprefixed := *value
+	unprefixed.Key = strings.TrimPrefix(value.Key, n.prefix)
+
+	return &unprefixed, true
+}
+
+// Put adds a new Data value and returns a success status bool.
+func (n NamespaceStore) Put(d *data.Data) bool {
+	prefixed := *d
+	prefixed.Key = n.prefix + d.Key
+
+	return n.store.Put(&prefixed)
+}
+
+// Delete removes the key and returns a success status bool.
+func (n NamespaceStore) Delete(key string) bool {
+	return n.store.Delete(n.prefix + key)
+}
+
+// Keys returns every key in the namespace.
+func (n NamespaceStore) Keys() []string {
+	keys := []string{}
+
+	for _, key := range n.store.Keys() {
+		if strings.HasPrefix(key, n.prefix) {
+			keys = append(keys, strings.TrimPrefix(key, n.prefix))
+		}
+	}
+
+	return keys
+}
+
+// ExcludeStore hides the keys in a set of namespaces from another Store, so
+// the rest of its keys can be used as if they were the only ones.
+type ExcludeStore struct {
+	store    store.Store
+	prefixes []string
+}
+
+// excluded returns true if the key is in one of the hidden namespaces.
+func (e ExcludeStore) excluded(key string) bool {
+	for _, prefix := range e.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Get returns a Data value and existence bool for the given key. Keys in
+// the hidden namespaces are never found.
+func (e ExcludeStore) Get(key string) (*data.Data, bool) {
+	if e.excluded(key) {
+		return nil, false
+	}
+
+	return e.store.Get(key)
+}
+
+// Put adds a new Data value and returns a success status bool. Keys in the
+// hidden namespaces are refused.
+func (e ExcludeStore) Put(d *data.Data) bool {
+	if e.excluded(d.Key) {
+		return false
+	}
+
+	return e.store.Put(d)
+}
+
+// Delete removes the key and returns a success status bool. Keys in the
+// hidden namespaces are refused.
+func (e ExcludeStore) Delete(key string) bool {
+	if e.excluded(key) {
+		return false
+	}
+
+	return e.store.Delete(key)
+}
+
+// Keys returns every key outside the hidden namespaces.
+func (e ExcludeStore) Keys() []string {
+	keys := []string{}
+
+	for _, key := range e.store.Keys() {
+		if !e.excluded(key) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// Close closes the underlying Store if it's an io.Closer.
+func (e ExcludeStore) Close() error {
+	if closer, ok := e.store.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// New returns a Store that keeps its keys in s under the prefix.
+func New(s store.Store, prefix string) *NamespaceStore {
+	return &NamespaceStore{s, prefix}
+}
+
+// Exclude returns a Store that uses s but hides every key starting with
+// one of the prefixes.
+func Exclude(s store.Store, prefixes ...string) *ExcludeStore {
+	return &ExcludeStore{s, prefixes}
+}
@@ -0,0 +1,54 @@
+package namespace
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/rlayte/toystore/data"
+	"github.com/rlayte/toystore/store/memory"
+)
+
+func TestNamespaceStore(t *testing.T) {
+	backend := memory.New()
+	hints := New(backend, "hints/")
+	rest := Exclude(backend, "hints/")
+
+	hints.Put(data.New("foo", "hint"))
+	rest.Put(data.New("foo", "value"))
+
+	if value, ok := hints.Get("foo"); !ok || value.Key != "foo" || value.Value != "hint" {
+		t.Errorf("Namespaced values should be found without their prefix, got %v", value)
+	}
+
+	if value, ok := rest.Get("foo"); !ok || value.Value != "value" {
+		t.Errorf("Namespaces should not share keys, got %v", value)
+	}
+
+	if keys := rest.Keys(); fmt.Sprint(keys) != "[foo]" {
+		t.Errorf("Namespaced keys should be hidden, got %v", keys)
+	}
+
+	if rest.Put(data.New("hints/bar", "value")) {
+		t.Error("Keys in a hidden namespace should be refused")
+	}
+
+	// A new wrapper over the same backend sees the same keys.
+	restarted := New(backend, "hints/")
+	keys := restarted.Keys()
+	sort.Strings(keys)
+
+	if fmt.Sprint(keys) != "[foo]" {
+		t.Errorf("Namespaced keys should be kept in the backend, got %v", keys)
+	}
+
+	restarted.Delete("foo")
+
+	if _, ok := hints.Get("foo"); ok {
+		t.Error("Deleted keys should not be found")
+	}
+
+	if _, ok := rest.Get("foo"); !ok {
+		t.Error("Deleting a namespaced key should not delete the same key outside it")
+	}
+}
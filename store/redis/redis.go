@@ -1,6 +1,24 @@
 package redis
 
-import radix "github.com/fzzy/radix/redis"
+import (
+	"fmt"
+
+	radix "github.com/fzzy/radix/redis"
+)
+
+// DialError is returned by New when the redis server can't be reached.
+type DialError struct {
+	URL string
+	Err error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("redis: failed to connect to %s: %s", e.URL, e.Err)
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
 
 type RedisStore struct {
 	client *radix.Client
@@ -8,46 +26,50 @@ type RedisStore struct {
 
 func (r RedisStore) Get(key string) (string, bool) {
 	response := r.client.Cmd("GET", key)
-	if response.Type == radix.NilReply {
+	if response.Type == radix.NilReply || response.Err != nil {
 		return "", false // Empty string is just a holder?
 	}
 	value, err := response.Str()
 	if err != nil {
-		panic(err)
+		return "", false
 	}
 	return value, true
 }
 
 func (r RedisStore) Put(key string, value string) bool {
 	err := r.client.Cmd("SET", key, value).Err
-	if err != nil {
-		panic(err)
-	}
+	return err == nil
+}
 
+func (r RedisStore) Delete(key string) bool {
+	err := r.client.Cmd("DEL", key).Err
 	return err == nil
 }
 
-func New(url string) *RedisStore {
+func (r RedisStore) Close() error {
+	return r.client.Close()
+}
+
+func New(url string) (*RedisStore, error) {
 	client, err := radix.Dial("tcp", url)
 	if err != nil {
-		panic(err)
+		return nil, &DialError{url, err}
 	}
-	return &RedisStore{client}
+	return &RedisStore{client}, nil
 }
 
+// Keys returns every key in the store. Keys that can't be read are skipped.
 func (r RedisStore) Keys() []string {
 	values := r.client.Cmd("KEYS")
 	elems := values.Elems
 
-	output := make([]string, len(elems))
-	i := 0
+	output := make([]string, 0, len(elems))
 	for _, e := range elems {
 		key, err := e.Str()
 		if err != nil {
-			panic(err)
+			continue
 		}
-		output[i] = key
-		i++
+		output = append(output, key)
 	}
 	return output
 }
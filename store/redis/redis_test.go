@@ -23,8 +23,16 @@ func CheckInside(t *testing.T, strings []string, item string) {
 	t.Errorf("%s is not inside the given list.", item)
 }
 
+func newStore(t *testing.T) *RedisStore {
+	res, err := New("localhost:6379")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
 func TestRedisStore(t *testing.T) {
-	res := New("localhost:6379")
+	res := newStore(t)
 	res.Put("foo", "bar")
 	str, success := res.Get("foo")
 	if !success {
@@ -34,13 +42,13 @@ func TestRedisStore(t *testing.T) {
 }
 
 func TestFailure(t *testing.T) {
-	res := New("localhost:6379")
+	res := newStore(t)
 	_, success := res.Get("lol")
 	Equal(t, success, false)
 }
 
 func TestKeys(t *testing.T) {
-	res := New("localhost:6379")
+	res := newStore(t)
 	res.Put("foo", "bar")
 	res.Put("left", "right")
 	if len(res.Keys()) == 0 {
@@ -49,3 +57,10 @@ func TestKeys(t *testing.T) {
 	CheckInside(t, res.Keys(), "foo")
 	CheckInside(t, res.Keys(), "left")
 }
+
+func TestDialError(t *testing.T) {
+	_, err := New("localhost:1")
+	if _, ok := err.(*DialError); !ok {
+		t.Errorf("Expected DialError, got %v", err)
+	}
+}
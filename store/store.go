@@ -7,5 +7,6 @@ import "github.com/rlayte/toystore/data"
 type Store interface {
 	Get(string) (*data.Data, bool)
 	Put(*data.Data) bool
+	Delete(string) bool
 	Keys() []string
 }
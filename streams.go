@@ -0,0 +1,408 @@
+package toystore
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rlayte/toystore/data"
+)
+
+const (
+	// DefaultTransferChunkSize is used if Config.TransferChunkSize isn't
+	// set.
+	DefaultTransferChunkSize = 100
+
+	// DefaultTransferRetryInterval is used if Config.TransferRetryInterval
+	// isn't set.
+	DefaultTransferRetryInterval = time.Second * 10
+
+	// DefaultTransferRetries is used if Config.TransferRetries isn't set.
+	DefaultTransferRetries = 3
+
+	// Time to wait before resending the first unacknowledged chunk. It
+	// doubles after every attempt.
+	transferRetryBackoff = time.Millisecond * 100
+)
+
+// TransferProgress describes how far a stream to another node has got.
+type TransferProgress struct {
+	// Address of the node receiving the stream.
+	Address string
+
+	// Number of keys acknowledged and the number queued.
+	Sent  int
+	Total int
+
+	// When the stream started.
+	Started time.Time
+}
+
+// stream is a set of keys being sent to a node in key order, and how many
+// of them have been acknowledged.
+type stream struct {
+	keys []string
+
+	// Last position of each key in keys. Keys before sent can be queued
+	// again.
+	queued map[string]int
+
+	sent    int
+	started time.Time
+}
+
+// Streams sends keys to the nodes that have gained replica responsibility
+// for them, e.g. when a node joins or changes weight.
+// Each node's keys are sent in chunks of ChunkSize and the stream records
+// its progress after every acknowledged chunk. Chunks that aren't
+// acknowledged are resent up to Retries times with exponential backoff. If
+// a node still can't be reached, its stream resumes from the last
+// acknowledged chunk on the next scan instead of starting again.
+// Values are read from the Store when each chunk is sent so the latest
+// version is always streamed, and chunks are paced so no more than
+// RateLimit keys are sent per second across every stream. Chunks are never
+// larger than RateLimit.
+type Streams struct {
+	ScanInterval time.Duration
+	ChunkSize    int
+	Retries      int
+	RetryBackoff time.Duration
+
+	// Maximum number of keys sent per second across all streams. 0 means
+	// unlimited.
+	RateLimit int
+
+	// Called after every acknowledged chunk. May be nil. Streams to
+	// different nodes call it concurrently.
+	OnProgress func(TransferProgress)
+
+	store   *Toystore
+	client  Transferrer
+	pending map[string]*stream
+	lock    *sync.Mutex
+
+	// Serializes sending to each address so chunks aren't sent twice.
+	// Guarded by lock.
+	sending map[string]*sync.Mutex
+
+	// Earliest time the rate limit allows the next chunk to be sent, shared
+	// by every stream.
+	allowed time.Time
+	limit   *sync.Mutex
+
+	wake chan bool
+	stop chan bool
+	done chan bool
+}
+
+// scan sends pending streams whenever keys are added and retries
+// unfinished streams periodically.
+// It returns once Stop is called.
+func (s *Streams) scan() {
+	defer close(s.done)
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.wake:
+		case <-time.After(s.ScanInterval):
+		}
+
+		s.Flush()
+	}
+}
+
+// Start runs the scan process in the background until Stop is called.
+func (s *Streams) Start() {
+	go s.scan()
+}
+
+// Stop ends the scan process and waits for it to return.
+func (s *Streams) Stop() {
+	close(s.stop)
+	<-s.done
+}
+
+// Add queues keys to be sent to the address. Keys that are already queued
+// and haven't been sent yet aren't queued twice.
+func (s *Streams) Add(address string, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	current, ok := s.pending[address]
+
+	if !ok {
+		current = &stream{queued: map[string]int{}, started: time.Now()}
+		s.pending[address] = current
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if i, ok := current.queued[key]; !ok || i < current.sent {
+			current.queued[key] = len(current.keys)
+			current.keys = append(current.keys, key)
+		}
+	}
+
+	select {
+	case s.wake <- true:
+	default:
+	}
+}
+
+// Progress returns the number of keys queued for the address and how many
+// of them have been sent.
+func (s *Streams) Progress(address string) (sent int, total int) {
+	progress := s.progress(address)
+	return progress.Sent, progress.Total
+}
+
+// progress returns the state of the stream to the address.
+func (s *Streams) progress(address string) TransferProgress {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if current, ok := s.pending[address]; ok {
+		return TransferProgress{address, current.sent, len(current.keys), current.started}
+	}
+
+	return TransferProgress{Address: address}
+}
+
+// Status returns the progress of every unfinished stream.
+func (s *Streams) Status() []TransferProgress {
+	s.lock.Lock()
+	addresses := []string{}
+	for address := range s.pending {
+		addresses = append(addresses, address)
+	}
+	s.lock.Unlock()
+
+	sort.Strings(addresses)
+	status := []TransferProgress{}
+
+	for _, address := range addresses {
+		status = append(status, s.progress(address))
+	}
+
+	return status
+}
+
+// chunk returns the values of the next chunk of keys to send to the
+// address, and the position in the stream after it.
+func (s *Streams) chunk(address string) ([]*data.Data, int, bool) {
+	s.lock.Lock()
+	current, ok := s.pending[address]
+
+	if !ok || current.sent == len(current.keys) {
+		delete(s.pending, address)
+		s.lock.Unlock()
+		return nil, 0, false
+	}
+
+	size := s.ChunkSize
+
+	if s.RateLimit > 0 && s.RateLimit < size {
+		size = s.RateLimit
+	}
+
+	end := current.sent + size
+
+	if end > len(current.keys) {
+		end = len(current.keys)
+	}
+
+	keys := current.keys[current.sent:end]
+	s.lock.Unlock()
+
+	values := []*data.Data{}
+
+	for _, key := range keys {
+		if value, ok := s.store.Data.Get(key); ok {
+			values = append(values, value)
+		}
+	}
+
+	return values, end, true
+}
+
+// transfer sends a chunk, resending it with exponential backoff until it's
+// acknowledged or Retries is reached.
+func (s *Streams) transfer(address string, values []*data.Data) bool {
+	backoff := s.RetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		if s.client.Transfer(address, values) {
+			return true
+		}
+
+		if attempt >= s.Retries {
+			return false
+		}
+
+		s.store.Metrics.TransferRetries.Add(1)
+
+		select {
+		case <-s.stop:
+			return false
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+	}
+}
+
+// throttle charges n keys against RateLimit and waits until they can be
+// sent, or until Stop is called. Every stream is charged, so sending to
+// several nodes doesn't exceed the limit.
+func (s *Streams) throttle(n int) {
+	if s.RateLimit <= 0 {
+		return
+	}
+
+	s.limit.Lock()
+
+	if now := time.Now(); s.allowed.Before(now) {
+		s.allowed = now
+	}
+
+	s.allowed = s.allowed.Add(time.Duration(n) * time.Second / time.Duration(s.RateLimit))
+	wait := time.Until(s.allowed)
+	s.limit.Unlock()
+
+	select {
+	case <-s.stop:
+	case <-time.After(wait):
+	}
+}
+
+// sendLock returns the lock that serializes sending to the address.
+func (s *Streams) sendLock(address string) *sync.Mutex {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.sending[address]; !ok {
+		s.sending[address] = &sync.Mutex{}
+	}
+
+	return s.sending[address]
+}
+
+// Send sends every queued key to the address one chunk at a time.
+// It returns a TransferError if a chunk isn't acknowledged after Retries
+// attempts, leaving the rest of the stream queued.
+func (s *Streams) Send(address string) error {
+	sending := s.sendLock(address)
+	sending.Lock()
+	defer sending.Unlock()
+
+	for {
+		values, end, ok := s.chunk(address)
+
+		if !ok {
+			return nil
+		}
+
+		if len(values) > 0 {
+			s.throttle(len(values))
+
+			if !s.transfer(address, values) {
+				sent, total := s.Progress(address)
+				return &TransferError{address, total - sent}
+			}
+		}
+
+		s.lock.Lock()
+		s.pending[address].sent = end
+		s.lock.Unlock()
+
+		s.store.Metrics.KeysTransferred.Add(int64(len(values)))
+		progress := s.progress(address)
+		s.store.log.Printf("Streamed %d of %d keys to %s", progress.Sent, progress.Total, address)
+
+		if s.OnProgress != nil {
+			s.OnProgress(progress)
+		}
+	}
+}
+
+// Flush sends every pending stream and returns the addresses that
+// couldn't be reached, in sorted order. Streams are sent in parallel so an
+// unreachable node doesn't hold up the others.
+func (s *Streams) Flush() []string {
+	s.lock.Lock()
+	addresses := []string{}
+	for address := range s.pending {
+		addresses = append(addresses, address)
+	}
+	s.lock.Unlock()
+
+	failed := []string{}
+	lock := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+
+	for _, address := range addresses {
+		wg.Add(1)
+
+		go func(address string) {
+			defer wg.Done()
+
+			if err := s.Send(address); err != nil {
+				s.store.log.Printf("Streaming to %s failed: %s", address, err)
+
+				lock.Lock()
+				failed = append(failed, address)
+				lock.Unlock()
+			}
+		}(address)
+	}
+
+	wg.Wait()
+	sort.Strings(failed)
+
+	return failed
+}
+
+// NewStreams returns a new instance using the chunk size, retries, rate
+// limit and retry interval defined in config.
+func NewStreams(config Config, store *Toystore, client Transferrer) *Streams {
+	s := &Streams{
+		ScanInterval: config.TransferRetryInterval,
+		ChunkSize:    config.TransferChunkSize,
+		Retries:      config.TransferRetries,
+		RetryBackoff: transferRetryBackoff,
+		RateLimit:    config.TransferRateLimit,
+		OnProgress:   config.TransferProgress,
+		store:        store,
+		client:       client,
+		pending:      map[string]*stream{},
+		lock:         &sync.Mutex{},
+		sending:      map[string]*sync.Mutex{},
+		limit:        &sync.Mutex{},
+		wake:         make(chan bool, 1),
+		stop:         make(chan bool),
+		done:         make(chan bool),
+	}
+
+	if s.ScanInterval == 0 {
+		s.ScanInterval = DefaultTransferRetryInterval
+	}
+
+	if s.ChunkSize == 0 {
+		s.ChunkSize = DefaultTransferChunkSize
+	}
+
+	if s.Retries == 0 {
+		s.Retries = DefaultTransferRetries
+	} else if s.Retries < 0 {
+		s.Retries = 0
+	}
+
+	return s
+}
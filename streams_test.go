@@ -0,0 +1,346 @@
+package toystore
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/rlayte/toystore/data"
+	"github.com/rlayte/toystore/ring"
+)
+
+// FlakyTransferrer records transferred items and fails every call from
+// failAt until it's reset, or until recoverAt if it's set.
+type FlakyTransferrer struct {
+	sent      map[string][]*data.Data
+	calls     int
+	failAt    int
+	recoverAt int
+	lock      sync.Mutex
+}
+
+func (f *FlakyTransferrer) Transfer(address string, items []*data.Data) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.calls++
+
+	if f.failAt > 0 && f.calls >= f.failAt && (f.recoverAt == 0 || f.calls < f.recoverAt) {
+		return false
+	}
+
+	f.sent[address] = append(f.sent[address], items...)
+	return true
+}
+
+func TestStreamsResume(t *testing.T) {
+	node := newLocalNode()
+	client := &FlakyTransferrer{sent: map[string][]*data.Data{}, failAt: 3}
+	streams := NewStreams(Config{}, node, client)
+	streams.RetryBackoff = time.Millisecond
+	streams.ChunkSize = 3
+	keys := []string{}
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprint(i)
+		node.Merge(data.New(key, "value"))
+		keys = append(keys, key)
+	}
+
+	streams.Add("b:3001", keys)
+
+	if err := streams.Send("b:3001"); err == nil {
+		t.Fatal("Send should fail when a chunk isn't acknowledged")
+	}
+
+	if sent, total := streams.Progress("b:3001"); sent != 6 || total != 10 {
+		t.Errorf("Two chunks should have been sent, progress was %d of %d", sent, total)
+	}
+
+	// Keys that haven't been sent yet aren't queued twice.
+	client.failAt = 0
+	streams.Add("b:3001", keys[6:8])
+
+	if failed := streams.Flush(); len(failed) != 0 {
+		t.Errorf("Flush should succeed, but %v failed", failed)
+	}
+
+	counts := map[string]int{}
+
+	for _, value := range client.sent["b:3001"] {
+		counts[value.Key]++
+	}
+
+	for _, key := range keys {
+		if counts[key] != 1 {
+			t.Errorf("%s should be sent once, but was sent %d times", key, counts[key])
+		}
+	}
+
+	if _, total := streams.Progress("b:3001"); total != 0 {
+		t.Error("Finished streams should be removed")
+	}
+}
+
+func TestStreamsRetry(t *testing.T) {
+	node := newLocalNode()
+	client := &FlakyTransferrer{sent: map[string][]*data.Data{}, failAt: 2, recoverAt: 4}
+	streams := NewStreams(Config{}, node, client)
+	streams.RetryBackoff = time.Millisecond
+	streams.ChunkSize = 2
+	streams.Retries = 2
+	progress := []TransferProgress{}
+	streams.OnProgress = func(p TransferProgress) {
+		progress = append(progress, p)
+	}
+
+	keys := []string{}
+
+	for i := 0; i < 6; i++ {
+		key := fmt.Sprint(i)
+		node.Merge(data.New(key, "value"))
+		keys = append(keys, key)
+	}
+
+	streams.Add("b:3001", keys)
+
+	if err := streams.Send("b:3001"); err != nil {
+		t.Fatalf("Failed chunks should be retried, got %s", err)
+	}
+
+	if len(client.sent["b:3001"]) != 6 {
+		t.Errorf("Expected 6 keys to be sent, got %d", len(client.sent["b:3001"]))
+	}
+
+	if retries := node.Metrics.TransferRetries.Load(); retries != 2 {
+		t.Errorf("Expected 2 retries, got %d", retries)
+	}
+
+	if sent := node.Metrics.KeysTransferred.Load(); sent != 6 {
+		t.Errorf("Expected 6 keys transferred, got %d", sent)
+	}
+
+	if len(progress) != 3 || progress[2].Sent != 6 || progress[2].Total != 6 {
+		t.Errorf("Progress should be reported after every chunk, got %v", progress)
+	}
+}
+
+func TestStreamsRateLimit(t *testing.T) {
+	node := newLocalNode()
+	client := &FlakyTransferrer{sent: map[string][]*data.Data{}}
+	streams := NewStreams(Config{}, node, client)
+	streams.ChunkSize = 5
+	streams.RateLimit = 100
+	keys := []string{}
+
+	for i := 0; i < 15; i++ {
+		key := fmt.Sprint(i)
+		node.Merge(data.New(key, "value"))
+		keys = append(keys, key)
+	}
+
+	streams.Add("b:3001", keys)
+	start := time.Now()
+
+	if err := streams.Send("b:3001"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each chunk waits 50ms for its keys.
+	if elapsed := time.Since(start); elapsed < time.Millisecond*150 {
+		t.Errorf("15 keys at 100 keys/s should take at least 150ms, took %s", elapsed)
+	}
+}
+
+func TestStreamsRateLimitIsShared(t *testing.T) {
+	node := newLocalNode()
+	client := &FlakyTransferrer{sent: map[string][]*data.Data{}}
+	streams := NewStreams(Config{}, node, client)
+	streams.ChunkSize = 5
+	streams.RateLimit = 100
+	keys := []string{}
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprint(i)
+		node.Merge(data.New(key, "value"))
+		keys = append(keys, key)
+	}
+
+	streams.Add("b:3001", keys)
+	streams.Add("c:3001", keys)
+	start := time.Now()
+
+	if failed := streams.Flush(); len(failed) != 0 {
+		t.Fatalf("Flush should succeed, but %v failed", failed)
+	}
+
+	if elapsed := time.Since(start); elapsed < time.Millisecond*200 {
+		t.Errorf("20 keys to two nodes at 100 keys/s should take at least 200ms, took %s", elapsed)
+	}
+}
+
+func TestStreamsChunksNoLargerThanRateLimit(t *testing.T) {
+	node := newLocalNode()
+	streams := NewStreams(Config{}, node, &FlakyTransferrer{sent: map[string][]*data.Data{}})
+	streams.RateLimit = 4
+	keys := []string{}
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprint(i)
+		node.Merge(data.New(key, "value"))
+		keys = append(keys, key)
+	}
+
+	streams.Add("b:3001", keys)
+
+	if values, _, _ := streams.chunk("b:3001"); len(values) != 4 {
+		t.Errorf("Chunks should be limited to RateLimit keys, got %d", len(values))
+	}
+}
+
+func TestAddMemberStreamsGainedKeys(t *testing.T) {
+	node, _ := newLocalCluster(3)
+	node.ReplicationLevel = 2
+	transferrer := &FakeTransferrer{sent: map[string][]*data.Data{}, status: true}
+	node.Streams = NewStreams(Config{}, node, transferrer)
+	node.Departures = NewDepartures(Config{}, node)
+	node.Ring.SetWeight(node.rpcAddress(), 10)
+	before := map[string]ring.PreferenceList{}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint(i)
+		node.Merge(data.New(key, "value"))
+		before[key], _ = node.Ring.FindN(key, node.ReplicationLevel)
+	}
+
+	node.AddMember(&MemberlistNode{&memberlist.Node{Name: "d", Meta: []byte("d:3001")}})
+	node.Streams.Flush()
+
+	expected := 0
+
+	for key, nodes := range before {
+		after, _ := node.Ring.FindN(key, node.ReplicationLevel)
+		found := false
+
+		for _, value := range transferrer.sent["d:3001"] {
+			found = found || value.Key == key
+		}
+
+		gained := after.Contains("d:3001") && sender(nodes, "") == node.rpcAddress()
+
+		if gained {
+			expected++
+		}
+
+		if gained != found {
+			t.Errorf("%s streamed to d should be %v: before %v after %v", key, gained, nodes, after)
+		}
+	}
+
+	if expected == 0 {
+		t.Error("d should gain some of the node's keys")
+	}
+
+	for address := range transferrer.sent {
+		if address != "d:3001" {
+			t.Errorf("Only d gains keys, but keys were sent to %s", address)
+		}
+	}
+}
+
+func TestStreamsRequeueSentKeys(t *testing.T) {
+	node := newLocalNode()
+	client := &FlakyTransferrer{sent: map[string][]*data.Data{}, failAt: 2}
+	streams := NewStreams(Config{}, node, client)
+	streams.RetryBackoff = time.Millisecond
+	streams.ChunkSize = 1
+
+	for _, key := range []string{"a", "b", "c"} {
+		node.Merge(data.New(key, "value"))
+	}
+
+	streams.Add("b:3001", []string{"a", "b", "c"})
+	streams.Send("b:3001")
+	streams.Add("b:3001", []string{"a", "b"})
+
+	if sent, total := streams.Progress("b:3001"); sent != 1 || total != 4 {
+		t.Errorf("Only the sent key should be queued again, progress was %d of %d", sent, total)
+	}
+
+	client.failAt = 0
+
+	if failed := streams.Flush(); len(failed) != 0 {
+		t.Fatalf("Flush should succeed, but %v failed", failed)
+	}
+
+	counts := map[string]int{}
+
+	for _, value := range client.sent["b:3001"] {
+		counts[value.Key]++
+	}
+
+	if counts["a"] != 2 || counts["b"] != 1 || counts["c"] != 1 {
+		t.Errorf("a should be sent again and the others once, got %v", counts)
+	}
+}
+
+// BlockingTransferrer blocks transfers to one address until release is
+// closed.
+type BlockingTransferrer struct {
+	blocked string
+	release chan bool
+}
+
+func (b *BlockingTransferrer) Transfer(address string, items []*data.Data) bool {
+	if address == b.blocked {
+		<-b.release
+	}
+
+	return true
+}
+
+func TestStreamsSendIndependently(t *testing.T) {
+	node := newLocalNode()
+	client := &BlockingTransferrer{"b:3001", make(chan bool)}
+	streams := NewStreams(Config{}, node, client)
+	node.Merge(data.New("foo", "value"))
+
+	streams.Add("b:3001", []string{"foo"})
+	streams.Add("c:3001", []string{"foo"})
+
+	done := make(chan error)
+	go func() { done <- streams.Send("b:3001") }()
+
+	sent := make(chan error)
+	go func() { sent <- streams.Send("c:3001") }()
+
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("A blocked stream should not hold up streams to other nodes")
+	}
+
+	close(client.release)
+
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStreamsNoRetries(t *testing.T) {
+	node := newLocalNode()
+	client := &FlakyTransferrer{sent: map[string][]*data.Data{}, failAt: 1}
+	streams := NewStreams(Config{TransferRetries: -1}, node, client)
+	node.Merge(data.New("foo", "value"))
+
+	streams.Add("b:3001", []string{"foo"})
+
+	if err := streams.Send("b:3001"); err == nil || client.calls != 1 {
+		t.Errorf("A failed chunk should not be resent, sent %d times", client.calls)
+	}
+}
@@ -6,13 +6,33 @@
 package toystore
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/rlayte/toystore/data"
 	"github.com/rlayte/toystore/ring"
 	"github.com/rlayte/toystore/store"
+	"github.com/rlayte/toystore/store/namespace"
+)
+
+const (
+	// DefaultTokens is used if Config.Tokens isn't set.
+	DefaultTokens = 64
+
+	// Prefix of the records that identify the node across restarts, kept in
+	// its Store alongside the data. Data can't be stored under keys that
+	// start with it.
+	nodeNamespace = "\x00node/"
+
+	// Number of counters reserved each time the counter is saved, so it
+	// isn't written for every write the node coordinates.
+	counterBlock = 1024
 )
 
 // Toystore represents an individual node in a Toystore cluster.
@@ -29,12 +49,29 @@ type Toystore struct {
 	// Port number to serve RPC requests between nodes.
 	RPCPort int
 
+	// Port number for gossip between nodes.
+	GossipPort int
+
 	// Host address to bind to.
 	Host string
 
 	// Concrete Store implementation to persist data.
 	Data store.Store
 
+	// How replicas that return stale data to reads are repaired.
+	ReadRepair ReadRepairMode
+
+	// How the node coordinating a request is chosen from the key's
+	// preference list.
+	Coordinator CoordinatorStrategy
+
+	// Counters for events on this node.
+	Metrics *Metrics
+
+	// Resolves concurrent versions into a single value. If nil concurrent
+	// versions are kept as siblings.
+	Resolver Resolver
+
 	// Hash ring for nodes in the cluster.
 	Ring ring.Ring
 
@@ -44,14 +81,70 @@ type Toystore struct {
 	// Store of hinted data meant for other nodes.
 	Hints *HintedHandoff
 
+	// Removes expired tombstones from Data.
+	Collector *GarbageCollector
+
+	// Synchronizes data with other replicas in the background.
+	AntiEntropy *AntiEntropy
+
+	// Tracks members that have left and removes them permanently.
+	Departures *Departures
+
+	// Streams keys to nodes that have gained replica responsibility.
+	Streams *Streams
+
 	// Concrete PeerClient implementation to make calls to other nodes.
 	client PeerClient
 
 	// Concrete Transferrer implementation to transfer data to other nodes.
 	transferrer Transferrer
 
+	// Concrete Streamer implementation to fetch ranges when bootstrapping.
+	streamer Streamer
+
+	// RPC server handling requests from other nodes.
+	handler *RpcHandler
+
 	// Custom logger. Format: [Toystore] {host}: {statement}
 	log *log.Logger
+
+	// Number of requests in flight to each coordinator, keyed by address.
+	inflight sync.Map
+
+	// Keeps the replica ID and counter across restarts. See restore.
+	meta store.Store
+
+	// Identifies the node in the dots of the writes it coordinates.
+	replicaID string
+
+	// Last counter used to version a write coordinated by this node, and
+	// the highest counter saved in meta.
+	counter  uint64
+	reserved uint64
+
+	// Capacity of this node relative to the others, gossiped in its meta
+	// data.
+	capacity int
+
+	// True once the node has handed its ranges to other nodes and left the
+	// ring, gossiped in its meta data.
+	decommissioned bool
+
+	// True while the node is streaming its ranges and refusing reads.
+	bootstrapping atomic.Bool
+
+	// True once the node has started streaming its ranges to other nodes
+	// and is refusing writes, so none arrive after they've been streamed.
+	decommissioning atomic.Bool
+
+	// Serializes versioning and merging so concurrent writes to the same
+	// key can't drop each other's versions. Also guards capacity and
+	// decommissioned.
+	lock *sync.Mutex
+
+	// Ensures the node is only stopped once, and the result of doing so.
+	stopping sync.Once
+	stopErr  error
 }
 
 // rpcAddress returns a string for the RPC address.
@@ -59,49 +152,175 @@ func (t *Toystore) rpcAddress() string {
 	return fmt.Sprintf("%s:%d", t.Host, t.RPCPort)
 }
 
+// weight returns the node's capacity weight, which is at least 1.
+func (t *Toystore) weight() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.capacity < 1 {
+		return 1
+	}
+
+	return t.capacity
+}
+
 // Get finds the key on the correct node in the cluster and returns
 // the value and an existence bool.
-// If the key is on the current node then it coordinates the operation.
-// Otherwise it sends the coordination request to the correct node.
+// If the key has concurrent versions the newest one is returned. Use
+// GetVersions to see all of them.
+// Deleted keys aren't found.
+// The coordinator is chosen from the key's preference list according to
+// Config.Coordinator. If it's the current node then it coordinates the
+// operation. Otherwise it sends the coordination request to that node.
 func (t *Toystore) Get(key string) (interface{}, bool) {
-	address := t.Ring.Find(key)
-	var data *data.Data
-	var ok bool
+	value, err := t.GetContext(context.Background(), key)
+	return value, err == nil
+}
 
-	if t.isCoordinator(address) {
-		data, ok = t.CoordinateGet(key)
-	} else {
-		t.log.Printf("Forwarding GET request to %s for %s", address, key)
-		data, ok = t.client.CoordinateGet(address, key)
+// GetContext is like Get but the request is bounded by ctx and failures
+// are returned as errors.
+// Returns ErrNotFound if the key doesn't exist or was deleted, a
+// QuorumError if fewer than R replicas responded, an UnreachableError if
+// the coordinator couldn't be contacted, or ErrTimeout if the context's
+// deadline passed.
+func (t *Toystore) GetContext(ctx context.Context, key string) (interface{}, error) {
+	return t.GetWithOptions(ctx, key, Options{})
+}
+
+// GetWithOptions is like GetContext but reads from the number of replicas
+// set by opts instead of the node's R. Returns an OptionsError if opts are
+// invalid.
+func (t *Toystore) GetWithOptions(ctx context.Context, key string, opts Options) (interface{}, error) {
+	r, err := t.reads(opts)
+
+	if err != nil {
+		return nil, err
 	}
 
-	if ok {
-		return data.Value, ok
+	data, err := t.get(ctx, key, r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if data == nil || data.IsDeleted() {
+		return nil, ErrNotFound
 	}
 
-	return nil, ok
+	return data.Live()[0].Value, nil
+}
+
+// GetVersions returns every concurrent version of the key's value along
+// with their causal context and an existence bool.
+// The context should be passed to PutVersion when writing a value that
+// reconciles the versions.
+func (t *Toystore) GetVersions(key string) ([]interface{}, CausalContext, bool) {
+	data, err := t.get(context.Background(), key, t.R)
+
+	if err != nil || data == nil {
+		return nil, CausalContext{}, false
+	}
+
+	values := []interface{}{}
+
+	for _, version := range data.Live() {
+		values = append(values, version.Value)
+	}
+
+	// The context still covers tombstones so writes supersede them.
+	return values, CausalContext{data.Context()}, len(values) > 0
+}
+
+// get finds the key on the correct node in the cluster and returns the
+// stored data, or nil if no replica has it. The coordinator waits for r
+// replicas.
+func (t *Toystore) get(ctx context.Context, key string, r int) (*data.Data, error) {
+	address := t.coordinator(key)
+	defer t.track(address)()
+
+	if t.isCoordinator(address) {
+		return t.coordinateGet(ctx, key, r)
+	}
+
+	t.log.Printf("Forwarding GET request to %s for %s", address, key)
+	return t.client.CoordinateGet(ctx, address, key, r)
 }
 
 // Put finds the key on the correct node in the cluster, sets
 // the value and returns a status bool.
-// If the key is owned by current node then it coordinates the operation.
-// Otherwise it sends the coordination request to the correct node.
-func (t *Toystore) Put(key string, value interface{}) (ok bool) {
-	address := t.Ring.Find(key)
+// The new value supersedes every version of the key the coordinator knows
+// about.
+// The coordinator is chosen in the same way as Get.
+func (t *Toystore) Put(key string, value interface{}) bool {
+	return t.PutContext(context.Background(), key, value) == nil
+}
+
+// PutContext is like Put but the request is bounded by ctx and failures
+// are returned as errors.
+// Returns a QuorumError if fewer than W replicas acknowledged the write,
+// an UnreachableError if the coordinator couldn't be contacted, or
+// ErrTimeout if the context's deadline passed.
+func (t *Toystore) PutContext(ctx context.Context, key string, value interface{}) error {
+	return t.PutWithOptions(ctx, key, value, Options{})
+}
+
+// PutWithOptions is like PutContext but waits for the number of replicas
+// set by opts instead of the node's W. Returns an OptionsError if opts are
+// invalid.
+func (t *Toystore) PutWithOptions(ctx context.Context, key string, value interface{}, opts Options) error {
+	w, err := t.writes(opts)
+
+	if err != nil {
+		return err
+	}
+
+	return t.put(ctx, data.New(key, value), w)
+}
+
+// PutVersion sets the value using the causal context returned by
+// GetVersions and returns a status bool.
+// The new value supersedes exactly the versions in the context. Versions
+// written concurrently are kept as siblings. An empty context behaves
+// like Put.
+func (t *Toystore) PutVersion(key string, value interface{}, causal CausalContext) bool {
+	d := data.New(key, value)
+	d.Clock = causal.clock.Copy()
+	return t.put(context.Background(), d, t.W) == nil
+}
+
+// Delete removes the key from the cluster and returns a status bool.
+// The key is replaced by a tombstone that's replicated like any other write
+// so stale replicas can't bring the value back. Tombstones are purged once
+// they're older than Config.TombstoneGracePeriod.
+func (t *Toystore) Delete(key string) bool {
+	return t.DeleteContext(context.Background(), key) == nil
+}
+
+// DeleteContext is like Delete but the request is bounded by ctx and
+// failures are returned as errors in the same way as PutContext.
+func (t *Toystore) DeleteContext(ctx context.Context, key string) error {
+	return t.put(ctx, data.NewTombstone(key), t.W)
+}
+
+// put finds the coordinator for the value and asks it to write it to w
+// replicas.
+func (t *Toystore) put(ctx context.Context, value *data.Data, w int) error {
+	address := t.coordinator(value.Key)
+	defer t.track(address)()
 
 	if t.isCoordinator(address) {
-		ok = t.CoordinatePut(data.New(key, value))
-	} else {
-		t.log.Printf("Forwarding PUT request to coordinator %s for %s", address, value)
-		ok = t.client.CoordinatePut(address, data.New(key, value))
+		return t.coordinatePut(ctx, value, w)
 	}
-	return
+
+	t.log.Printf("Forwarding PUT request to coordinator %s for %s", address, value)
+	return t.client.CoordinatePut(ctx, address, value, w)
 }
 
 // GetString returns a string of the value for the specified key/value pair.
 func (t *Toystore) GetString(key string) (string, bool) {
 	d, ok := t.Get(key)
-	return d.(string), ok
+	s, _ := d.(string)
+	return s, ok
 }
 
 // isCoordinator returns true if the current node is the owner
@@ -110,179 +329,816 @@ func (t *Toystore) isCoordinator(address string) bool {
 	return address == t.rpcAddress()
 }
 
+// replicaResult is the response from a single node in a key's preference
+// list.
+type replicaResult struct {
+	address string
+	// Address of the failed node the response stands in for, if any.
+	hint  string
+	value *data.Data
+	err   error
+}
+
+// detach returns a context that keeps the deadline of ctx but isn't
+// cancelled with it, so replica requests can finish after the coordinator
+// has returned to the caller.
+func detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	detached := context.WithoutCancel(ctx)
+
+	if d, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(detached, d)
+	}
+
+	return context.WithCancel(detached)
+}
+
+// readReplica reads the key from a node in its preference list. Nodes
+// standing in for a failed replica also return the hints they hold for it.
+func (t *Toystore) readReplica(ctx context.Context, node ring.Replica, key string) replicaResult {
+	if node.Address == t.rpcAddress() {
+		if t.bootstrapping.Load() {
+			return replicaResult{node.Address, node.HintFor, nil, ErrBootstrapping}
+		}
+
+		t.log.Printf("Coordinator retrieving %s", key)
+		return replicaResult{node.Address, node.HintFor, t.hinted(node.HintFor, key), nil}
+	}
+
+	var value *data.Data
+	var err error
+
+	if node.HintFor != "" {
+		t.log.Printf("GET request to %s for %s (%s)", node.Address, key, node.HintFor)
+		value, err = t.client.HintGet(ctx, node.Address, node.HintFor, key)
+	} else {
+		t.log.Printf("GET request to %s for %s", node.Address, key)
+		value, err = t.client.Get(ctx, node.Address, key)
+	}
+
+	if err != nil {
+		t.log.Printf("GET request to %s for %s failed: %s", node.Address, key, err)
+	}
+
+	return replicaResult{node.Address, node.HintFor, value, err}
+}
+
+// hinted returns the local value of the key, reconciled with any hint held
+// for it on behalf of the failed node. If hint is empty only the local
+// value is returned. Returns nil if neither exists.
+func (t *Toystore) hinted(hint string, key string) *data.Data {
+	value, _ := t.Data.Get(key)
+
+	if hint == "" {
+		return value
+	}
+
+	if held, ok := t.Hints.Get(hint, key); ok {
+		if value == nil {
+			return held
+		}
+
+		return value.Reconcile(held)
+	}
+
+	return value
+}
+
+// writeReplica writes the value to a node in its preference list. If hint
+// is set the node stores the value on behalf of that address, including
+// when the coordinator is the stand-in itself.
+func (t *Toystore) writeReplica(ctx context.Context, address string, hint string, value *data.Data) replicaResult {
+	var err error
+
+	if address == t.rpcAddress() {
+		if t.decommissioning.Load() {
+			err = ErrDecommissioning
+		} else if hint != "" {
+			t.log.Printf("Coordinator saving hint for %s (%s)", hint, value)
+			t.Hints.Put(value, hint)
+		} else {
+			t.log.Printf("Coordinator saving %s", value)
+			t.Merge(value)
+		}
+	} else if hint != "" {
+		t.log.Printf("Sending hint to %s for %s (%s)", address, hint, value)
+		err = t.client.HintPut(ctx, address, hint, value)
+	} else {
+		t.log.Printf("PUT request to %s for %v", address, value)
+		err = t.client.Put(ctx, address, value)
+	}
+
+	if err != nil {
+		t.log.Printf("PUT request to %s for %v failed: %s", address, value, err)
+	}
+
+	return replicaResult{address, hint, value, err}
+}
+
 // CoordinateGet organizes the get request between the collaborating nodes.
-// It sends get requests to all nodes in the key's preference list and keeps
-// track of success/failures. If there are more successful reads than config.R
-// it returns the value and true. Otherwise it returns the value and false.
-func (t *Toystore) CoordinateGet(key string) (*data.Data, bool) {
+// It sends get requests to all nodes in the key's preference list in
+// parallel and returns as soon as config.R of them respond. Nodes standing
+// in for a failed replica answer with the hints they hold for it, so reads
+// can reach R during an outage (a sloppy quorum). Nodes that don't
+// have the key count as successful reads. Responses that arrive later are
+// still merged in the background.
+// Replicas that returned stale or missing data are sent the merged value
+// according to config.ReadRepair.
+// It returns the merged value, or nil if no node has the key. If there are
+// fewer successful reads than config.R it also returns a QuorumError, or
+// ErrTimeout if the context's deadline passed first.
+func (t *Toystore) CoordinateGet(ctx context.Context, key string) (*data.Data, error) {
+	return t.coordinateGet(ctx, key, t.R)
+}
+
+// coordinateGet is like CoordinateGet but waits for r successful reads
+// instead of config.R.
+func (t *Toystore) coordinateGet(ctx context.Context, key string, r int) (*data.Data, error) {
 	t.log.Printf("Coordinating GET request %s.", key)
 
-	values := []*data.Data{}
-	nodes := t.Ring.FindN(key, t.ReplicationLevel)
-	reads := 0
+	nodes, err := t.Ring.FindN(key, t.ReplicationLevel)
 
-	for _, address := range nodes {
-		if address != t.rpcAddress() {
-			t.log.Printf("GET request to %s for %s", address, key)
-			value, ok := t.client.Get(address, key)
+	if err != nil {
+		t.log.Printf("Preference list for %s is incomplete: %s", key, err)
+	}
 
-			if ok {
-				values = append(values, value)
-				reads++
-			}
-		} else {
-			t.log.Printf("Coordinator retrieving %s", key)
-			value, ok := t.Data.Get(key)
+	results := make(chan replicaResult, len(nodes))
+	replicaCtx, cancel := detach(ctx)
 
-			if ok {
-				values = append(values, value)
-				reads++
-			}
+	for _, node := range nodes {
+		// Local reads are cheap so don't need their own thread.
+		if node.Address == t.rpcAddress() {
+			results <- t.readReplica(replicaCtx, node, key)
+			continue
 		}
+
+		go func(node ring.Replica) {
+			results <- t.readReplica(replicaCtx, node, key)
+		}(node)
 	}
 
-	// Add the newest value found to the local database
-	for _, value := range values {
-		t.Merge(value)
+	responses := []replicaResult{}
+	merge := func(result replicaResult) bool {
+		if result.err != nil {
+			return false
+		}
+
+		// Add the newest value found to the local database
+		if result.value != nil {
+			t.Merge(result.value)
+		}
+
+		return true
 	}
 
-	value, _ := t.Data.Get(key)
+	reads, pending := t.collect(ctx, results, len(nodes), r, func(result replicaResult) bool {
+		if !merge(result) {
+			return false
+		}
+
+		responses = append(responses, result)
+		return true
+	})
+
+	value, ok := t.Data.Get(key)
+
+	// Siblings can remain from before a Resolver was configured.
+	if ok && len(value.Siblings) > 0 && t.Resolver != nil {
+		t.Merge(t.resolve(value))
+		value, ok = t.Data.Get(key)
+	}
+
+	if !ok {
+		value = nil
+	}
+
+	if t.ReadRepair == ReadRepairSync {
+		t.readRepair(ctx, key, responses)
+		responses = nil
+	}
 
-	return value, reads >= t.R
+	go func() {
+		defer cancel()
+
+		for i := 0; i < pending; i++ {
+			if result := <-results; merge(result) {
+				responses = append(responses, result)
+			}
+		}
+
+		if t.ReadRepair != ReadRepairOff {
+			t.readRepair(replicaCtx, key, responses)
+		}
+	}()
+
+	if reads < r {
+		if ctx.Err() != nil {
+			return value, contextError(ctx)
+		}
+
+		return value, &QuorumError{"GET", reads, r}
+	}
+
+	return value, nil
 }
 
 // CoordinatePut organizes the put request between the collaborating nodes.
-// It sends put requests to all nodes in the key's preference list and keeps
-// track of success/failures. If there are more successful writes than config.W
-// it returns true. Otherwise it returns false.
+// It sends put requests to all nodes in the key's preference list in
+// parallel and returns as soon as config.W of them acknowledge the write.
+// The remaining writes continue in the background. If there are fewer
+// successful writes than config.W it returns a QuorumError, or ErrTimeout if
+// the context's deadline passed first.
 //
 // If any nodes in the key's preference list are dead it will attempt to put
 // the value on other nodes with a hint to its correct location.
-func (t *Toystore) CoordinatePut(value *data.Data) bool {
+//
+// The coordinator assigns the value a new version before replicating it.
+func (t *Toystore) CoordinatePut(ctx context.Context, value *data.Data) error {
+	return t.coordinatePut(ctx, value, t.W)
+}
+
+// coordinatePut is like CoordinatePut but waits for w successful writes
+// instead of config.W.
+func (t *Toystore) coordinatePut(ctx context.Context, value *data.Data, w int) error {
 	key := value.Key
-	t.log.Printf("Coordinating PUT request %v", value)
+	t.version(value)
+	t.log.Printf("Coordinating PUT request %v %s", value, value.Version())
 
-	nodes := t.Ring.FindN(key, t.ReplicationLevel)
-	writes := 0
+	nodes, err := t.Ring.FindN(key, t.ReplicationLevel)
 
-	for address, hint := range nodes {
-		if address != t.rpcAddress() {
-			var ok bool
+	if err != nil {
+		t.log.Printf("Preference list for %s is incomplete: %s", key, err)
+	}
 
-			if hint != address {
-				t.log.Printf("Sending hint to %s for %s (%s)", address, hint, value)
-				ok = t.client.HintPut(address, string(hint), value)
-			} else {
-				t.log.Printf("PUT request to %s for %v", address, value)
-				ok = t.client.Put(address, value)
-			}
+	results := make(chan replicaResult, len(nodes))
+	replicaCtx, cancel := detach(ctx)
 
-			if ok {
-				writes++
-			}
-		} else {
-			t.log.Printf("Coordinator saving %s", value)
-			ok := t.Data.Put(value)
+	for _, node := range nodes {
+		// Save locally first so the coordinator always has its own writes
+		// when versioning the next one.
+		if node.Address == t.rpcAddress() {
+			results <- t.writeReplica(replicaCtx, node.Address, node.HintFor, value)
+			continue
+		}
+
+		go func(node ring.Replica) {
+			results <- t.writeReplica(replicaCtx, node.Address, node.HintFor, value)
+		}(node)
+	}
+
+	succeeded := func(result replicaResult) bool {
+		return result.err == nil
+	}
 
-			if ok {
-				writes++
+	writes, pending := t.collect(ctx, results, len(nodes), w, succeeded)
+
+	go func() {
+		defer cancel()
+
+		for i := 0; i < pending; i++ {
+			<-results
+		}
+	}()
+
+	if writes < w {
+		if ctx.Err() != nil {
+			return contextError(ctx)
+		}
+
+		return &QuorumError{"PUT", writes, w}
+	}
+
+	return nil
+}
+
+// collect receives replica results until required of them succeed, every
+// replica has responded, or the context is done. It returns the number of
+// successful results and the number still pending.
+func (t *Toystore) collect(ctx context.Context, results chan replicaResult, total int, required int, success func(replicaResult) bool) (acks int, pending int) {
+	pending = total
+
+	for pending > 0 && acks < required {
+		select {
+		case <-ctx.Done():
+			return
+		case result := <-results:
+			pending--
+
+			if success(result) {
+				acks++
 			}
 		}
 	}
 
-	return writes >= t.W
+	return
+}
+
+// lastEpoch is the most recent epoch handed out by newEpoch.
+var lastEpoch atomic.Int64
+
+// newEpoch returns a number that's unique to each node given a new replica
+// ID in the process and increases between runs.
+func newEpoch() int64 {
+	for {
+		last := lastEpoch.Load()
+		next := time.Now().UnixNano()
+
+		if next <= last {
+			next = last + 1
+		}
+
+		if lastEpoch.CompareAndSwap(last, next) {
+			return next
+		}
+	}
+}
+
+// restore loads the replica ID and counter saved by a previous run of the
+// node, so restarts don't add new entries to every clock.
+// Counters are only reserved in meta, so a node whose store is empty is
+// given a new replica ID rather than hand out dots that other replicas'
+// clocks already cover, which would make them discard its new writes as
+// stale.
+func (t *Toystore) restore() {
+	id, ok := t.meta.Get("id")
+
+	if ok {
+		t.replicaID, ok = id.Value.(string)
+	}
+
+	if !ok {
+		t.replicaID = fmt.Sprintf("%s#%d", t.rpcAddress(), newEpoch())
+		t.meta.Delete("counter")
+		t.meta.Put(data.New("id", t.replicaID))
+		return
+	}
+
+	if counter, ok := t.meta.Get("counter"); ok {
+		t.counter, _ = counter.Value.(uint64)
+		t.reserved = t.counter
+	}
 }
 
-// Merge updates the data object only if its Timestamp is later than the
-// current value.
+// version assigns a new Dot from the current node to value.
+// If the value has no causal context it's based on the versions the
+// coordinator currently holds, so it supersedes all of them.
+func (t *Toystore) version(value *data.Data) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	address := t.replicaID
+	value.Clock = value.Clock.Copy()
+	known := value.Clock.Copy()
+
+	if current, ok := t.Data.Get(value.Key); ok {
+		if len(value.Clock) == 0 {
+			value.Clock = current.Context()
+		}
+
+		known.Merge(current.Context())
+	}
+
+	if known[address] > t.counter {
+		t.counter = known[address]
+	}
+
+	t.counter++
+	value.Dot = data.Dot{Node: address, Counter: t.counter}
+
+	if t.counter > t.reserved {
+		t.reserved = t.counter + counterBlock
+		t.meta.Put(data.New("counter", t.reserved))
+	}
+}
+
+// Merge adds any versions of the data object that aren't superseded by the
+// current value. Concurrent versions are kept as siblings unless a
+// Resolver is configured.
 // If the key doesn't exist it adds it.
-// Requires Store implementation to be thread safe.
+// Returns true if the stored value changed.
 func (t *Toystore) Merge(data *data.Data) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
 	current, ok := t.Data.Get(data.Key)
 
-	if !ok || data.IsLater(current) {
-		t.Data.Put(data)
-		return true
+	if ok && current.Descends(data) {
+		return false
+	}
+
+	if ok {
+		data = current.Reconcile(data)
+	}
+
+	value := t.resolve(data)
+
+	if !t.Data.Put(value) {
+		return false
 	}
 
-	return false
+	t.changed(value.Key, value)
+
+	return true
 }
 
-// Transfer sends a list of keys to another node in the cluster.
-func (t *Toystore) Transfer(address string) {
-	keys := t.Data.Keys()
-	items := []*data.Data{}
+// changed updates the anti-entropy trees after the stored value of key
+// changes. value is nil if the key was deleted.
+// The caller must hold t.lock.
+func (t *Toystore) changed(key string, value *data.Data) {
+	if t.AntiEntropy != nil {
+		t.AntiEntropy.Update(key, value)
+	}
+}
+
+// resolve replaces concurrent versions with a single value using the
+// configured Resolver. If there's no Resolver or no siblings it returns
+// the value unchanged.
+// Tombstones aren't passed to the Resolver, so a write concurrent with a
+// delete wins.
+func (t *Toystore) resolve(value *data.Data) *data.Data {
+	if t.Resolver == nil || len(value.Siblings) == 0 {
+		return value
+	}
+
+	versions := value.Versions()
+	live := value.Live()
+	var resolved interface{}
+
+	switch len(live) {
+	case 0:
+		resolved = nil
+	case 1:
+		resolved = live[0].Value
+	default:
+		resolved = t.Resolver.Resolve(value.Key, live)
+	}
 
-	for _, key := range keys {
-		val, _ := t.Data.Get(key)
+	t.log.Printf("Resolved %d versions of %s to %v", len(versions), value.Key, resolved)
+
+	return data.Resolve(versions, resolved)
+}
 
-		if t.Ring.Find(key) == address {
-			items = append(items, val)
+// Transfer streams every local key the address is a replica for to it.
+// Returns a TransferError if some of the keys couldn't be sent; they stay
+// queued and are retried in the background.
+func (t *Toystore) Transfer(address string) error {
+	keys := []string{}
+
+	for _, key := range t.Data.Keys() {
+		if nodes, _ := t.Ring.FindN(key, t.ReplicationLevel); nodes.Contains(address) {
+			keys = append(keys, key)
 		}
 	}
 
-	if len(items) > 0 {
-		t.log.Printf("Transferring to %s. Ring: %s", address, t.Ring, items)
-		t.transferrer.Transfer(address, items)
+	t.Streams.Add(address, keys)
+
+	return t.Streams.Send(address)
+}
+
+// preferenceLists returns the current preference list of every local key.
+func (t *Toystore) preferenceLists() map[string]ring.PreferenceList {
+	lists := map[string]ring.PreferenceList{}
+
+	for _, key := range t.Data.Keys() {
+		lists[key], _ = t.Ring.FindN(key, t.ReplicationLevel)
+	}
+
+	return lists
+}
+
+// moves compares the preference lists from before a change to the ring
+// with the current ones and returns the keys each node has gained replica
+// responsibility for.
+// Every node makes the same comparison when it sees the change, so to send
+// each key once only the first of a key's previous replicas sends it. The
+// departed node, if any, is skipped unless it's the local node, in which
+// case it sends every key itself.
+func (t *Toystore) moves(before map[string]ring.PreferenceList, departed string) map[string][]string {
+	moved := map[string][]string{}
+
+	for key, nodes := range before {
+		if departed != t.rpcAddress() && sender(nodes, departed) != t.rpcAddress() {
+			continue
+		}
+
+		after, _ := t.Ring.FindN(key, t.ReplicationLevel)
+
+		for _, node := range after {
+			if node.Address != t.rpcAddress() && !replicates(nodes, node.Address) {
+				moved[node.Address] = append(moved[node.Address], key)
+			}
+		}
+	}
+
+	return moved
+}
+
+// rebalance queues the keys each node has gained since before to be
+// streamed to it in the background.
+func (t *Toystore) rebalance(before map[string]ring.PreferenceList) {
+	for address, keys := range t.moves(before, "") {
+		t.log.Printf("Rebalancing %d items to %s", len(keys), address)
+		t.Streams.Add(address, keys)
+	}
+}
+
+// SetWeight changes the node's capacity weight and broadcasts it to the
+// cluster so every node gives it a proportional share of the ring.
+// Only the ranges whose owner changes are moved: each node streams the
+// keys it's responsible for to the nodes that gain them once it sees the
+// new weight.
+// Returns a ConfigError if weight is less than 1.
+func (t *Toystore) SetWeight(weight int) error {
+	if weight < 1 {
+		return &ConfigError{"Weight", "must be at least 1"}
+	}
+
+	t.lock.Lock()
+	t.capacity = weight
+	t.lock.Unlock()
+
+	before := t.preferenceLists()
+	t.Ring.SetWeight(t.rpcAddress(), weight)
+	t.rebalance(before)
+
+	if t.Members != nil {
+		return t.Members.Update()
 	}
+
+	return nil
 }
 
-// AddMember adds a new node to the hash ring.
-// If the new node is adjacent to the current node then it transfers
-// any keys in its range that should be owned by the new node.
+// AddMember adds a new node to the hash ring, or updates its weight if it's
+// already a member. Members that have been decommissioned are removed from
+// the ring instead.
+// Keys the local node stores that the new node, or any other node, has
+// become a replica for are streamed to them. A member that rejoins after a
+// transient failure already has its data, so reviving it doesn't move any
+// keys; any hints held for it are delivered straight away.
 func (t *Toystore) AddMember(member Member) {
-	t.log.Printf("Adding member %s", member.Name())
-	t.Ring.Add(member.Address())
-	localAddress := t.rpcAddress()
-	adjacent := t.Ring.Adjacent(member.Address(), localAddress)
+	if member.Decommissioned() {
+		if member.Address() != t.rpcAddress() {
+			t.log.Printf("Member %s has been decommissioned", member.Name())
+			t.Departures.Forget(member.Address())
+		}
 
-	if adjacent {
-		t.Transfer(member.Address())
+		return
 	}
+
+	t.log.Printf("Adding member %s with weight %d", member.Name(), member.Weight())
+	t.Departures.Revive(member.Address())
+	t.Ring.Revive(member.Address())
+	t.Hints.Alive(member.Address())
+
+	before := t.preferenceLists()
+	t.Ring.SetWeight(member.Address(), member.Weight())
+	t.rebalance(before)
 }
 
-// RemoveMember removes a member from the hash ring.
+// RemoveMember marks a member as failed in the hash ring. Hints for it are
+// held until it rejoins. If it doesn't rejoin within config.RemovalTimeout
+// it's removed permanently.
 func (t *Toystore) RemoveMember(member Member) {
-	if member.Address() != t.rpcAddress() {
+	if member.Address() != t.rpcAddress() && !member.Decommissioned() {
 		t.log.Printf("Removing member %s", member.Name())
 		t.Ring.Fail(member.Address())
+		t.Departures.Fail(member.Address())
+		t.Hints.Fail(member.Address())
+	}
+}
+
+// handoff sends every local key to the nodes that will be responsible for
+// it once the current node has left the ring. Keys meant for failed nodes
+// are sent as hints. Keys are streamed in acknowledged chunks like any
+// other range movement.
+func (t *Toystore) handoff() {
+	items := map[string][]string{}
+
+	for _, key := range t.Data.Keys() {
+		value, ok := t.Data.Get(key)
+
+		if !ok {
+			continue
+		}
+
+		nodes, _ := t.Ring.FindN(key, t.ReplicationLevel)
+
+		for _, node := range nodes {
+			if node.Address == t.rpcAddress() {
+				continue
+			}
+
+			if node.HintFor != "" {
+				t.client.HintPut(context.Background(), node.Address, node.HintFor, value)
+			} else {
+				items[node.Address] = append(items[node.Address], key)
+			}
+		}
+	}
+
+	for address, keys := range items {
+		t.log.Printf("Handing off %d items to %s", len(keys), address)
+		t.Streams.Add(address, keys)
+
+		if err := t.Streams.Send(address); err != nil {
+			t.log.Printf("Handoff to %s failed: %s", address, err)
+		}
+	}
+}
+
+// handoffHints sends any hints that can't be delivered to their location
+// to another live node so they aren't lost when the current node stops.
+// Hints that can't be handed off stay in the hint store for the next time
+// the node starts.
+func (t *Toystore) handoffHints() {
+	for hint := range t.Hints.Flush() {
+		for _, value := range t.Hints.Remove(hint) {
+			address := t.Ring.Find(value.Key)
+
+			if address == t.rpcAddress() || address == "" {
+				t.log.Printf("Keeping hint for %s (%s). No live nodes", hint, value)
+				t.Hints.Put(value, hint)
+				continue
+			}
+
+			if err := t.client.HintPut(context.Background(), address, hint, value); err != nil {
+				t.Hints.Put(value, hint)
+			}
+		}
 	}
 }
 
+// Stop gracefully removes the node from the cluster.
+// It stops accepting requests, hands off its data and any pending hints to
+// the nodes that will take over its ranges, leaves the gossip cluster and
+// closes the Store if it implements io.Closer.
+// The node can't be used after Stop returns. Calling Stop again has no
+// effect and returns the result of the first call.
+func (t *Toystore) Stop() error {
+	t.stopping.Do(func() {
+		t.stopErr = t.stop()
+	})
+
+	return t.stopErr
+}
+
+// stop shuts the node down. It must only be called once.
+func (t *Toystore) stop() error {
+	t.log.Printf("Stopping")
+
+	// Stop background processes so they don't race with the handoff.
+	t.Hints.Stop()
+	t.Collector.Stop()
+	t.AntiEntropy.Stop()
+	t.Departures.Stop()
+	t.Streams.Stop()
+
+	// Stop accepting requests from other nodes.
+	err := t.handler.Close()
+
+	// Route around the current node for the rest of the handoff. A
+	// decommissioned node has already streamed its data and hasn't accepted
+	// writes since.
+	t.Ring.Fail(t.rpcAddress())
+
+	if !t.isDecommissioned() {
+		t.handoff()
+	}
+
+	t.handoffHints()
+
+	if leaveErr := t.Members.Leave(); err == nil {
+		err = leaveErr
+	}
+
+	if closer, ok := t.client.(io.Closer); ok {
+		closer.Close()
+	}
+
+	if closer, ok := t.Data.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
 // New creates a new Toystore instance using the config variables.
 // It starts the RPC server and gossip protocols to handle node
 // communication between the cluster.
-func New(config Config) *Toystore {
+// Returns a ConfigError if the config is invalid, a ListenError if the RPC
+// server can't be started, or a GossipError if the gossip server can't be
+// started or the seed node can't be joined.
+func New(config Config) (*Toystore, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
 	t := &Toystore{
 		ReplicationLevel: config.ReplicationLevel,
 		W:                config.W,
 		R:                config.R,
 		Host:             config.Host,
 		RPCPort:          config.RPCPort,
-		Ring:             ring.NewHashRing(),
-		Data:             config.Store,
+		GossipPort:       config.GossipPort,
+		Data:             namespace.Exclude(config.Store, hintNamespace, nodeNamespace),
+		Resolver:         config.Resolver,
+		ReadRepair:       config.ReadRepair,
+		Coordinator:      config.Coordinator,
+		Metrics:          &Metrics{},
+		capacity:         config.Weight,
+		meta:             namespace.New(config.Store, nodeNamespace),
+		lock:             &sync.Mutex{},
 	}
 
+	t.restore()
+
+	// Refuse reads until the node has streamed its ranges.
+	t.bootstrapping.Store(config.Bootstrap)
+
 	// Set all logs to show current host
 	prefix := fmt.Sprintf("[Toystore] %s: ", t.Host)
 	t.log = log.New(os.Stderr, prefix, 0)
 
 	// Initialize RPC client for inter-node communication
-	client := NewRpcClient()
+	client := NewRpcClient(config)
 	t.client = client
 	t.transferrer = client
+	t.streamer = client
 
-	// Start new gossip protocol
-	t.Members = NewMemberlist(t, config.SeedAddress)
+	// Start hinted handoff scan, keeping hints alongside the data unless
+	// they have their own store.
+	if config.HintStore == nil {
+		config.HintStore = namespace.New(config.Store, hintNamespace)
+	}
+
+	t.Hints = NewHintedHandoff(config, t.Metrics, client)
+	t.Hints.Start()
 
-	// Start hinted handoff scan
-	t.Hints = NewHintedHandoff(config, client)
+	// Start tombstone garbage collection
+	t.Collector = NewGarbageCollector(config, t)
+	t.Collector.Start()
 
 	// Setup new hash ring
-	t.Ring.Add(t.rpcAddress())
+	hashRing := ring.NewHashRing()
+	hashRing.Tokens = config.Tokens
+
+	if hashRing.Tokens == 0 {
+		hashRing.Tokens = DefaultTokens
+	}
+
+	t.Ring = hashRing
+	t.Ring.SetWeight(t.rpcAddress(), t.weight())
 
-	// Start RPC server
-	NewRpcHandler(t)
+	// Start anti-entropy with other replicas
+	t.AntiEntropy = NewAntiEntropy(config, t, client)
+	t.AntiEntropy.Start()
+
+	// Start tracking departed members
+	t.Departures = NewDepartures(config, t)
+	t.Departures.Start()
+
+	// Start streaming ranges to nodes that gain them
+	t.Streams = NewStreams(config, t, client)
+	t.Streams.Start()
+
+	// Start RPC server before joining so other nodes can reach it as soon
+	// as they see the new member.
+	handler, err := NewRpcHandler(t)
+
+	if err != nil {
+		t.Hints.Stop()
+		t.Collector.Stop()
+		t.AntiEntropy.Stop()
+		t.Departures.Stop()
+		t.Streams.Stop()
+		client.Close()
+		return nil, err
+	}
+
+	t.handler = handler
+
+	// Start new gossip protocol
+	members, err := NewMemberlist(t, config.SeedAddress)
+
+	if err != nil {
+		t.handler.Close()
+		t.Hints.Stop()
+		t.Collector.Stop()
+		t.AntiEntropy.Stop()
+		t.Departures.Stop()
+		t.Streams.Stop()
+		client.Close()
+		return nil, err
+	}
+
+	t.Members = members
+
+	if config.Bootstrap {
+		if err := t.Bootstrap(); err != nil {
+			t.log.Printf("Bootstrap incomplete: %s", err)
+		}
+	}
 
-	return t
+	return t, nil
 }
@@ -44,7 +44,11 @@ func startNode(host string) {
 		config.SeedAddress = seedAddress
 	}
 
-	node := New(config)
+	node, err := New(config)
+
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	m.Lock()
 	nodes = append(nodes, node)
@@ -68,7 +72,14 @@ func startCluster() {
 }
 
 func stopCluster() {
-	// TODO: need to defined a Stop method on Toystore
+	log.Println("Stopping cluster")
+
+	m.Lock()
+	for _, node := range nodes {
+		node.Stop()
+	}
+	nodes = []*Toystore{}
+	m.Unlock()
 }
 
 func randomset(t *testing.T, i int) {
@@ -202,3 +213,25 @@ func TestIntegration__Partitions(t *testing.T) {
 
 	time.Sleep(time.Second)
 }
+
+func TestIntegration__StopTwice(t *testing.T) {
+	node, err := New(Config{
+		ReplicationLevel: 1,
+		W:                1,
+		R:                1,
+		RPCPort:          3011,
+		GossipPort:       3012,
+		Host:             "127.0.0.1",
+		Store:            memory.New(),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := node.Stop()
+
+	if err := node.Stop(); err != first {
+		t.Errorf("Stopping again should return %v, got %v", first, err)
+	}
+}